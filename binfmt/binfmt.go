@@ -0,0 +1,288 @@
+// Package binfmt reads and writes our program files.
+//
+// A program file starts with a header:
+//
+//	magic     4 bytes  "GSVM"
+//	version   2 bytes  the version of the instruction set targeted
+//	features  2 bytes  the optional instructions used, see opcode.Features
+//	entry     2 bytes  the address at which execution starts
+//	sections  2 bytes  the number of sections
+//
+// Then follows a table describing each section, as a two-byte kind, and
+// four-byte offset and size, then the sections themselves, and finally a
+// CRC32 checksum of everything before it.  All values are little-endian.
+//
+// Files without the magic number are legacy programs, holding nothing but
+// code.
+//
+// Relocatable objects, and libraries of them, are described in object.go.
+package binfmt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// Magic identifies a program file.  No instruction has the opcode 'G',
+// so a legacy program cannot start with it.
+var Magic = []byte("GSVM")
+
+// Version is the version of our instruction set.  Version 2 added jumps
+// and calls through registers, and relative to the next instruction.
+const Version = 2
+
+// The kinds of section a program may contain.
+const (
+	// SectionCode holds the instructions, loaded at address zero.
+	SectionCode = 1
+	// SectionData holds initialized data, loaded after the code.
+	SectionData = 2
+	// SectionSymbols holds the names, and addresses, of labels.
+	SectionSymbols = 3
+	// SectionLines maps addresses to source-lines.
+	SectionLines = 4
+	// SectionMovable is present, and empty, if the program may be
+	// loaded at any address.
+	SectionMovable = 7
+)
+
+// headerSize is the size of the fixed part of our header, and entrySize
+// the size of each entry in the section table.
+const (
+	headerSize = 12
+	entrySize  = 10
+)
+
+// Symbol is the name of an address.
+type Symbol struct {
+	Name string
+	Addr int
+}
+
+// Line records that the instruction at the given address came from the
+// given line of source.
+type Line struct {
+	Addr int
+	Line int
+}
+
+// Program is the contents of a program file.
+type Program struct {
+	// Version of the instruction set targeted.
+	Version int
+	// Features holds the optional instructions used.
+	Features uint16
+	// Entry is the address at which execution starts.
+	Entry int
+	// Code is loaded at address zero, and is read-only.
+	Code []byte
+	// Data is loaded after the code, and is writeable.
+	Data []byte
+	// Symbols holds the addresses of labels, and is optional.
+	Symbols []Symbol
+	// Lines holds source-lines, for debugging, and is optional.
+	Lines []Line
+	// Movable is set if the program holds no absolute addresses, so
+	// may be loaded anywhere: its jumps and calls are all relative,
+	// and no value is the address of a label.
+	Movable bool
+}
+
+// IsProgram returns true if the given file contents start with our
+// magic number, rather than being a legacy program.
+func IsProgram(data []byte) bool {
+	return bytes.HasPrefix(data, Magic)
+}
+
+// Load parses the contents of a program file, or wraps legacy bytecode
+// as a program.
+func Load(data []byte) (*Program, error) {
+	if !IsProgram(data) {
+		return &Program{Version: Version, Code: data}, nil
+	}
+	return Decode(data)
+}
+
+// section is a section of a file, prior to encoding.
+type section struct {
+	kind int
+	body []byte
+}
+
+// Encode returns the program as the contents of a file.
+func (p *Program) Encode() []byte {
+	return encode(Magic, p, nil)
+}
+
+// encode returns the contents of a file with the given magic number,
+// holding the given program and any extra sections.
+func encode(magic []byte, p *Program, extra []section) []byte {
+	sections := []section{{SectionCode, p.Code}}
+	if len(p.Data) > 0 {
+		sections = append(sections, section{SectionData, p.Data})
+	}
+	if len(p.Symbols) > 0 {
+		var body []byte
+		body = binary.LittleEndian.AppendUint16(body, uint16(len(p.Symbols)))
+		for _, s := range p.Symbols {
+			body = binary.LittleEndian.AppendUint16(body, uint16(s.Addr))
+			body = appendName(body, s.Name)
+		}
+		sections = append(sections, section{SectionSymbols, body})
+	}
+	if len(p.Lines) > 0 {
+		var body []byte
+		body = binary.LittleEndian.AppendUint32(body, uint32(len(p.Lines)))
+		for _, l := range p.Lines {
+			body = binary.LittleEndian.AppendUint16(body, uint16(l.Addr))
+			body = binary.LittleEndian.AppendUint32(body, uint32(l.Line))
+		}
+		sections = append(sections, section{SectionLines, body})
+	}
+	if p.Movable {
+		sections = append(sections, section{SectionMovable, nil})
+	}
+	sections = append(sections, extra...)
+
+	out := append([]byte{}, magic...)
+	out = binary.LittleEndian.AppendUint16(out, uint16(p.Version))
+	out = binary.LittleEndian.AppendUint16(out, p.Features)
+	out = binary.LittleEndian.AppendUint16(out, uint16(p.Entry))
+	out = binary.LittleEndian.AppendUint16(out, uint16(len(sections)))
+
+	offset := headerSize + entrySize*len(sections)
+	for _, s := range sections {
+		out = binary.LittleEndian.AppendUint16(out, uint16(s.kind))
+		out = binary.LittleEndian.AppendUint32(out, uint32(offset))
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(s.body)))
+		offset += len(s.body)
+	}
+	for _, s := range sections {
+		out = append(out, s.body...)
+	}
+	return binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(out))
+}
+
+// Decode parses the contents of a program file, validating its structure
+// and checksum.
+func Decode(data []byte) (*Program, error) {
+	p, _, err := decode(Magic, data)
+	return p, err
+}
+
+// decode parses the contents of a file with the given magic number,
+// returning any sections which aren't part of a program.
+func decode(magic []byte, data []byte) (*Program, map[int][]byte, error) {
+	if !bytes.HasPrefix(data, magic) {
+		return nil, nil, errors.New("missing magic number")
+	}
+	if len(data) < headerSize+4 {
+		return nil, nil, errors.New("truncated header")
+	}
+
+	body := data[:len(data)-4]
+	sum := binary.LittleEndian.Uint32(data[len(data)-4:])
+	if crc32.ChecksumIEEE(body) != sum {
+		return nil, nil, errors.New("checksum mismatch")
+	}
+
+	p := &Program{
+		Version:  int(binary.LittleEndian.Uint16(body[4:])),
+		Features: binary.LittleEndian.Uint16(body[6:]),
+		Entry:    int(binary.LittleEndian.Uint16(body[8:])),
+	}
+	count := int(binary.LittleEndian.Uint16(body[10:]))
+	if len(body) < headerSize+entrySize*count {
+		return nil, nil, errors.New("truncated section table")
+	}
+
+	extra := make(map[int][]byte)
+	seen := make(map[int]bool)
+	for i := 0; i < count; i++ {
+		entry := body[headerSize+entrySize*i:]
+		kind := int(binary.LittleEndian.Uint16(entry))
+		offset := int(binary.LittleEndian.Uint32(entry[2:]))
+		size := int(binary.LittleEndian.Uint32(entry[6:]))
+		if offset < 0 || size < 0 || offset+size > len(body) || offset+size < offset {
+			return nil, nil, fmt.Errorf("section %d lies outside the file", i)
+		}
+		if seen[kind] {
+			return nil, nil, fmt.Errorf("duplicate section of kind %d", kind)
+		}
+		seen[kind] = true
+		section := body[offset : offset+size]
+
+		var err error
+		switch kind {
+		case SectionCode:
+			p.Code = section
+		case SectionData:
+			p.Data = section
+		case SectionSymbols:
+			p.Symbols, err = decodeSymbols(section)
+		case SectionLines:
+			p.Lines, err = decodeLines(section)
+		case SectionMovable:
+			p.Movable = true
+		default:
+			// Unknown sections are returned to our caller,
+			// or skipped, so that later versions may add more.
+			extra[kind] = section
+		}
+		if err != nil {
+			return nil, nil, err
+		}
+	}
+	if !seen[SectionCode] {
+		return nil, nil, errors.New("missing code section")
+	}
+	return p, extra, nil
+}
+
+// decodeSymbols parses a symbol-table section.
+func decodeSymbols(section []byte) ([]Symbol, error) {
+	if len(section) < 2 {
+		return nil, errors.New("truncated symbol table")
+	}
+	count := int(binary.LittleEndian.Uint16(section))
+	section = section[2:]
+
+	var out []Symbol
+	for i := 0; i < count; i++ {
+		if len(section) < 2 {
+			return nil, errors.New("truncated symbol table")
+		}
+		s := Symbol{Addr: int(binary.LittleEndian.Uint16(section))}
+		var err error
+		if s.Name, section, err = readName(section[2:]); err != nil {
+			return nil, err
+		}
+		out = append(out, s)
+	}
+	return out, nil
+}
+
+// decodeLines parses a debug-line section.
+func decodeLines(section []byte) ([]Line, error) {
+	if len(section) < 4 {
+		return nil, errors.New("truncated line table")
+	}
+	count := int(binary.LittleEndian.Uint32(section))
+	section = section[4:]
+	if len(section) != 6*count {
+		return nil, errors.New("truncated line table")
+	}
+
+	var out []Line
+	for i := 0; i < count; i++ {
+		entry := section[6*i:]
+		out = append(out, Line{
+			Addr: int(binary.LittleEndian.Uint16(entry)),
+			Line: int(binary.LittleEndian.Uint32(entry[2:])),
+		})
+	}
+	return out, nil
+}
@@ -0,0 +1,46 @@
+package binfmt
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestRoundTrip(t *testing.T) {
+	prog := &Program{
+		Version:  Version,
+		Features: 3,
+		Entry:    2,
+		Code:     []byte{0x50, 0x50, 0x00},
+		Data:     []byte{1, 2, 3},
+		Symbols:  []Symbol{{Name: "main", Addr: 2}},
+		Lines:    []Line{{Addr: 0, Line: 1}, {Addr: 2, Line: 7}},
+		Movable:  true,
+	}
+
+	data := prog.Encode()
+	if !IsProgram(data) {
+		t.Fatalf("encoded program lacks our magic number")
+	}
+	out, err := Decode(data)
+	if err != nil {
+		t.Fatalf("failed to decode: %s", err)
+	}
+	if !reflect.DeepEqual(prog, out) {
+		t.Fatalf("round-trip failed:\n%v\n%v", prog, out)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	data := (&Program{Version: Version, Code: []byte{0x00}}).Encode()
+
+	tests := map[string][]byte{
+		"legacy":    {0x50, 0x00},
+		"truncated": data[:8],
+		"corrupt":   append(append([]byte{}, data[:len(data)-5]...), 0x51, 0, 0, 0, 0),
+	}
+	for name, input := range tests {
+		if _, err := Decode(input); err == nil {
+			t.Errorf("%s: decoded an invalid program", name)
+		}
+	}
+}
@@ -0,0 +1,217 @@
+package binfmt
+
+import (
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"hash/crc32"
+)
+
+// ObjectMagic identifies a relocatable object file, and LibraryMagic a
+// library of them.
+var (
+	ObjectMagic  = []byte("GSVO")
+	LibraryMagic = []byte("GSVL")
+)
+
+// The kinds of section only found in objects.
+const (
+	// SectionExports holds the names of the symbols an object exports.
+	SectionExports = 5
+	// SectionRelocs holds the relocations an object requires.
+	SectionRelocs = 6
+)
+
+// Reloc records that the address of the named symbol must be added to the
+// two bytes at Offset in an object's code, once the object has been placed.
+type Reloc struct {
+	Offset int
+	Symbol string
+}
+
+// Object is a relocatable object, produced by compiling a single file.
+// Its code is placed at address zero, and must be relocated by the linker.
+//
+// The symbol table holds every label the object defines, but only those
+// it exports may be used by other objects.  Any symbol which is the
+// target of a relocation, but not defined, must be imported.
+type Object struct {
+	Program
+	// Exports holds the names of the symbols other objects may use.
+	Exports []string
+	// Relocs holds the places which refer to symbols.
+	Relocs []Reloc
+}
+
+// IsObject returns true if the given file contents are an object.
+func IsObject(data []byte) bool {
+	return bytes.HasPrefix(data, ObjectMagic)
+}
+
+// Imports returns the names of the symbols the object refers to, but
+// does not define.
+func (o *Object) Imports() []string {
+	defined := make(map[string]bool)
+	for _, s := range o.Symbols {
+		defined[s.Name] = true
+	}
+	var out []string
+	for _, r := range o.Relocs {
+		if !defined[r.Symbol] {
+			defined[r.Symbol] = true
+			out = append(out, r.Symbol)
+		}
+	}
+	return out
+}
+
+// Encode returns the object as the contents of a file.
+func (o *Object) Encode() []byte {
+	var exports []byte
+	exports = binary.LittleEndian.AppendUint16(exports, uint16(len(o.Exports)))
+	for _, name := range o.Exports {
+		exports = appendName(exports, name)
+	}
+
+	var relocs []byte
+	relocs = binary.LittleEndian.AppendUint32(relocs, uint32(len(o.Relocs)))
+	for _, r := range o.Relocs {
+		relocs = binary.LittleEndian.AppendUint16(relocs, uint16(r.Offset))
+		relocs = appendName(relocs, r.Symbol)
+	}
+
+	return encode(ObjectMagic, &o.Program, []section{
+		{SectionExports, exports},
+		{SectionRelocs, relocs},
+	})
+}
+
+// DecodeObject parses the contents of an object file.
+func DecodeObject(data []byte) (*Object, error) {
+	p, extra, err := decode(ObjectMagic, data)
+	if err != nil {
+		return nil, err
+	}
+	o := &Object{Program: *p}
+
+	exports := extra[SectionExports]
+	if len(exports) < 2 {
+		return nil, errors.New("missing export table")
+	}
+	count := int(binary.LittleEndian.Uint16(exports))
+	exports = exports[2:]
+	for i := 0; i < count; i++ {
+		var name string
+		if name, exports, err = readName(exports); err != nil {
+			return nil, err
+		}
+		o.Exports = append(o.Exports, name)
+	}
+
+	relocs := extra[SectionRelocs]
+	if len(relocs) < 4 {
+		return nil, errors.New("missing relocation table")
+	}
+	count = int(binary.LittleEndian.Uint32(relocs))
+	relocs = relocs[4:]
+	for i := 0; i < count; i++ {
+		if len(relocs) < 2 {
+			return nil, errors.New("truncated relocation table")
+		}
+		r := Reloc{Offset: int(binary.LittleEndian.Uint16(relocs))}
+		if r.Symbol, relocs, err = readName(relocs[2:]); err != nil {
+			return nil, err
+		}
+		if r.Offset+2 > len(o.Code) {
+			return nil, fmt.Errorf("relocation at %04X lies outside the code", r.Offset)
+		}
+		o.Relocs = append(o.Relocs, r)
+	}
+	return o, nil
+}
+
+// Member is an object within a library.
+type Member struct {
+	// Name is the name of the file the object came from.
+	Name   string
+	Object *Object
+}
+
+// IsLibrary returns true if the given file contents are a library.
+func IsLibrary(data []byte) bool {
+	return bytes.HasPrefix(data, LibraryMagic)
+}
+
+// EncodeLibrary returns a library of the given objects, as the contents
+// of a file.
+func EncodeLibrary(members []Member) []byte {
+	out := append([]byte{}, LibraryMagic...)
+	out = binary.LittleEndian.AppendUint16(out, uint16(len(members)))
+	for _, m := range members {
+		obj := m.Object.Encode()
+		out = appendName(out, m.Name)
+		out = binary.LittleEndian.AppendUint32(out, uint32(len(obj)))
+		out = append(out, obj...)
+	}
+	return binary.LittleEndian.AppendUint32(out, crc32.ChecksumIEEE(out))
+}
+
+// DecodeLibrary parses the contents of a library file.
+func DecodeLibrary(data []byte) ([]Member, error) {
+	if !IsLibrary(data) {
+		return nil, errors.New("missing magic number")
+	}
+	if len(data) < len(LibraryMagic)+6 {
+		return nil, errors.New("truncated header")
+	}
+	body := data[:len(data)-4]
+	if crc32.ChecksumIEEE(body) != binary.LittleEndian.Uint32(data[len(data)-4:]) {
+		return nil, errors.New("checksum mismatch")
+	}
+
+	count := int(binary.LittleEndian.Uint16(body[len(LibraryMagic):]))
+	body = body[len(LibraryMagic)+2:]
+
+	var out []Member
+	for i := 0; i < count; i++ {
+		var m Member
+		var err error
+		if m.Name, body, err = readName(body); err != nil {
+			return nil, err
+		}
+		if len(body) < 4 {
+			return nil, errors.New("truncated library")
+		}
+		size := int(binary.LittleEndian.Uint32(body))
+		body = body[4:]
+		if size > len(body) {
+			return nil, errors.New("truncated library")
+		}
+		if m.Object, err = DecodeObject(body[:size]); err != nil {
+			return nil, fmt.Errorf("%s: %s", m.Name, err.Error())
+		}
+		body = body[size:]
+		out = append(out, m)
+	}
+	return out, nil
+}
+
+// appendName appends a name, prefixed by its length, which is limited to
+// 255 bytes.
+func appendName(out []byte, name string) []byte {
+	if len(name) > 255 {
+		name = name[:255]
+	}
+	out = append(out, byte(len(name)))
+	return append(out, name...)
+}
+
+// readName reads a length-prefixed name, returning the remaining bytes.
+func readName(data []byte) (string, []byte, error) {
+	if len(data) < 1 || len(data) < 1+int(data[0]) {
+		return "", nil, errors.New("truncated name")
+	}
+	len := int(data[0])
+	return string(data[1 : 1+len]), data[1+len:], nil
+}
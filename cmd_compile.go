@@ -8,29 +8,118 @@ import (
 	"gosc-vm/lexer"
 	"io/ioutil"
 	"path/filepath"
+	"strconv"
 	"strings"
 
 	"github.com/google/subcommands"
 )
 
+// stringList is a flag which may be given repeatedly, to build a list.
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(s string) error { *l = append(*l, s); return nil }
+
+// define passes each -D flag, "NAME" or "NAME=value", to the compiler as
+// a constant, whose value defaults to 1.
+func define(e *compiler.Compiler, defines []string) bool {
+	for _, d := range defines {
+		name, value, found := strings.Cut(d, "=")
+		val := int64(1)
+		if found {
+			var err error
+			val, err = strconv.ParseInt(value, 0, 32)
+			if err != nil {
+				fmt.Printf("Invalid value for -D %s\n", d)
+				return false
+			}
+		}
+		if name == "" {
+			fmt.Printf("Invalid -D %s, expected NAME=value\n", d)
+			return false
+		}
+		e.Define(name, int(val))
+	}
+	return true
+}
+
 type compileCmd struct {
+	include  stringList
+	defines  stringList
+	object   bool
+	entry    string
+	absolute bool
+	legacy   bool
+	strip    bool
 }
 
 //
 // Glue
 //
 func (*compileCmd) Name() string     { return "compile" }
-func (*compileCmd) Synopsys() string { return "Compiled a simple.vm program." }
+func (*compileCmd) Synopsis() string { return "Compiled a simple.vm program." }
 func (*compileCmd) Usage() string {
 	return `compile :
   Compile the given input file to a series of bytecodes.
+
+  Modules of the standard library are included by name, for example
+  with: .use "std/strings"
+
+  Other source files are included with: .include "file.in"
+
+  Labels starting with "." are local to the label before them, so each
+  routine may have its own ":.loop", while numeric labels such as ":1"
+  may be repeated, and are referred to as "1b" or "1f", meaning the
+  nearest before or after.
+
+  Constants are defined with ".equ NAME value", and integer operands may
+  be expressions of them, and of labels, e.g. "store #1, BUFFER + 16".
+
+  Code may be assembled only if a constant is defined, with .ifdef NAME,
+  or if its value is non-zero, with .if NAME, or ".if NAME >= 2", up to
+  the matching .else or .endif.  Constants may also be defined with
+  "-D NAME=value", to build variants of a program, such as "-D DEBUG".
+
+  An .if which tests a register, such as ".if #1 == 5", is instead tested
+  as the program runs, as are ".while #2 < #3 ... .endwhile" loops, and
+  ".for #4 = 0 to 10 ... .next" loops, which include the limit.  Within
+  a loop, .break leaves it, and .continue starts the next iteration.
+
+  Data is embedded with .byte, .word (16 bits) and .dword (32 bits), whose
+  values may be the addresses of labels, or strings with .ascii, and
+  .asciz to add a zero.  Space is reserved with ".space n", ".align n",
+  or ".org addr" to continue at the given address.  Code is read-only,
+  so buffers which are written belong in the data section, which follows
+  it: everything after .data is placed there, until a .text directive.
+  Execution starts at the first instruction, or at the label given with
+  ".entry name", or with -entry.
+
+  Registers may be named with ".reg counter = #3", until the end of the
+  enclosing .scope ... .endscope block.
+
+  Jumps and calls are encoded relative to the next instruction, so the
+  code may be loaded at any address, except for those to labels of other
+  objects.  Absolute addresses are used after the .absolute directive,
+  or with -absolute, until a .relative directive.  Addresses used as
+  values, such as that of "store #1, label", are always absolute.
+
+  With -c a relocatable object is written instead, which may export
+  labels with ".global name", and use those of other objects with
+  ".extern name".  Objects are combined with the link subcommand.
 `
 }
 
 //
-// Flag setup: no flags
+// Flag setup
 //
-func (p *compileCmd) setFlags(f *flag.FlagSet) {
+func (p *compileCmd) SetFlags(f *flag.FlagSet) {
+	f.Var(&p.include, "I", "A directory to search for included files, which may be given repeatedly.")
+	f.Var(&p.defines, "D", "Define a constant, as NAME=value, which may be given repeatedly.")
+	f.BoolVar(&p.object, "c", false, "Write a relocatable object (.o), for linking, rather than a program.")
+	f.StringVar(&p.entry, "entry", "", "The label at which execution should start.")
+	f.BoolVar(&p.absolute, "absolute", false, "Encode jumps and calls with absolute addresses, rather than relative ones.")
+	f.BoolVar(&p.legacy, "legacy", false, "Write bare bytecode, without a header.")
+	f.BoolVar(&p.strip, "strip", false, "Omit the symbol table and debug-lines.")
 }
 
 //
@@ -49,17 +138,58 @@ func (p *compileCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{
 		}
 
 		// Lex it
-		l := lexer.New(string(input))
+		l := lexer.NewFile(file, string(input))
 
 		// Compile it
 		e := compiler.New(l)
+		e.SetIncludePath(p.include)
+		if !define(e, p.defines) {
+			return subcommands.ExitFailure
+		}
+		e.SetEntry(p.entry)
+		e.SetAbsolute(p.absolute)
 		e.Compile()
 
 		// Write it out - remove the suffix from the file
 		name := strings.TrimSuffix(file, filepath.Ext(file))
 
+		// An object is written with a .o suffix.
+		if p.object {
+			fmt.Printf("Our bytecode is %d bytes long\n", len(e.Output()))
+			err = ioutil.WriteFile(name+".o", e.Object().Encode(), 0644)
+			if err != nil {
+				fmt.Printf("Error writing output file: %s\n", err.Error())
+				return subcommands.ExitFailure
+			}
+			continue
+		}
+
+		// Build the output, which is normally a program file.
+		prog := e.Program()
+		if p.strip {
+			prog.Symbols = nil
+			prog.Lines = nil
+		}
+		output := prog.Encode()
+		if p.legacy {
+			if prog.Entry != 0 {
+				fmt.Printf("A legacy program must start at its first instruction\n")
+				return subcommands.ExitFailure
+			}
+			if len(prog.Data) > 0 {
+				fmt.Printf("A legacy program cannot have a data section\n")
+				return subcommands.ExitFailure
+			}
+			output = e.Output()
+		}
+
 		// Add a .raw suffix to the file.
-		e.Write(name + ".raw")
+		fmt.Printf("Our bytecode is %d bytes long\n", len(e.Output()))
+		err = ioutil.WriteFile(name+".raw", output, 0644)
+		if err != nil {
+			fmt.Printf("Error writing output file: %s\n", err.Error())
+			return subcommands.ExitFailure
+		}
 	}
 	return subcommands.ExitSuccess
 }
@@ -0,0 +1,61 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"gosc-vm/binfmt"
+	"gosc-vm/disasm"
+	"io/ioutil"
+
+	"github.com/google/subcommands"
+)
+
+type disassembleCmd struct {
+}
+
+//
+// Glue
+//
+func (*disassembleCmd) Name() string     { return "disassemble" }
+func (*disassembleCmd) Synopsis() string { return "Disassemble a simple.vm program." }
+func (*disassembleCmd) Usage() string {
+	return `disassemble :
+  Show the bytecodes contained in the given input file as assembly,
+  which may be compiled again.
+`
+}
+
+//
+// Flag setup: no flags
+//
+func (p *disassembleCmd) SetFlags(f *flag.FlagSet) {
+}
+
+//
+// Entry-point.
+//
+func (p *disassembleCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	for _, file := range f.Args() {
+		code, err := ioutil.ReadFile(file)
+		if err != nil {
+			fmt.Printf("Error reading %s - %s\n", file, err.Error())
+			return subcommands.ExitFailure
+		}
+
+		// Legacy programs hold nothing but code.
+		if !binfmt.IsProgram(code) {
+			fmt.Print(disasm.Format(disasm.Disassemble(code)))
+			continue
+		}
+
+		prog, err := binfmt.Decode(code)
+		if err != nil {
+			fmt.Printf("Invalid program %s - %s\n", file, err.Error())
+			return subcommands.ExitFailure
+		}
+		fmt.Printf("# version %d, features %04X, entry %04X\n", prog.Version, prog.Features, prog.Entry)
+		fmt.Print(disasm.Format(disasm.DisassembleProgram(prog)))
+	}
+	return subcommands.ExitSuccess
+}
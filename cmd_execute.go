@@ -10,6 +10,9 @@ import (
 )
 
 type executeCmd struct {
+	heapDebug bool
+	printInt  string
+	noVerify  bool
 }
 
 //
@@ -24,15 +27,24 @@ func (*executeCmd) Usage() string {
 }
 
 //
-// Flag setup: no flags
+// Flag setup
 //
 func (p *executeCmd) SetFlags(f *flag.FlagSet) {
+	f.BoolVar(&p.heapDebug, "heap-debug", false, "Detect heap misuse, and report leaks on exit.")
+	f.StringVar(&p.printInt, "print-int", "hex", "How print_int shows integers: hex, decimal, or binary.")
+	f.BoolVar(&p.noVerify, "no-verify", false, "Don't verify the program before executing it.")
 }
 
 //
 // Entry point.
 //
 func (p *executeCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	mode, ok := cpu.ParsePrintMode(p.printInt)
+	if !ok {
+		fmt.Printf("Unknown print mode %s\n", p.printInt)
+		return subcommands.ExitFailure
+	}
+
 	//
 	// For each file on the command-line we can now parse and
 	// enqueue the jobs
@@ -40,8 +52,21 @@ func (p *executeCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{
 	for _, file := range f.Args() {
 		fmt.Printf("Loading file: %s\n", file)
 		c := cpu.NewCPU()
-		c.LoadFile(file)
-		c.Run()
+		c.SetHeapDebug(p.heapDebug)
+		c.SetPrintMode(mode)
+		if p.noVerify {
+			c.LoadFile(file)
+		} else {
+			prog, ok := loadVerified(file)
+			if !ok {
+				return subcommands.ExitFailure
+			}
+			c.LoadProgram(prog)
+		}
+		if err := c.Run(); err != nil {
+			fmt.Printf("Error running %s - %s\n", file, err.Error())
+			return subcommands.ExitFailure
+		}
 	}
 	return subcommands.ExitSuccess
 }
@@ -0,0 +1,117 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"gosc-vm/binfmt"
+	"gosc-vm/compiler"
+	"gosc-vm/lexer"
+	"gosc-vm/link"
+	"gosc-vm/std"
+	"io/ioutil"
+
+	"github.com/google/subcommands"
+)
+
+type linkCmd struct {
+	output  string
+	entry   string
+	library bool
+}
+
+//
+// Glue
+//
+func (*linkCmd) Name() string     { return "link" }
+func (*linkCmd) Synopsis() string { return "Link objects into a simple.vm program." }
+func (*linkCmd) Usage() string {
+	return `link :
+  Combine the given objects, and the objects needed from the given
+  libraries, into a single program.
+
+  Modules of the standard library may be given by name, e.g. std/strings,
+  and are used as libraries.
+
+  With -lib the objects are instead bundled into a library.
+`
+}
+
+//
+// Flag setup
+//
+func (p *linkCmd) SetFlags(f *flag.FlagSet) {
+	f.StringVar(&p.output, "o", "a.raw", "The file to write.")
+	f.StringVar(&p.entry, "entry", "", "The exported label at which execution should start.")
+	f.BoolVar(&p.library, "lib", false, "Write a library of the objects, rather than a program.")
+}
+
+//
+// Entry-point.
+//
+func (p *linkCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	var objects, libraries []link.Input
+
+	for _, file := range f.Args() {
+		// A module of the standard library is compiled as needed.
+		if src, ok := std.Source(file); ok {
+			e := compiler.New(lexer.New(src))
+			e.Compile()
+			libraries = append(libraries, link.Input{Name: file, Object: e.Object()})
+			continue
+		}
+
+		data, err := ioutil.ReadFile(file)
+		if err != nil {
+			fmt.Printf("Error reading %s - %s\n", file, err.Error())
+			return subcommands.ExitFailure
+		}
+
+		switch {
+		case binfmt.IsObject(data):
+			obj, err := binfmt.DecodeObject(data)
+			if err != nil {
+				fmt.Printf("Invalid object %s - %s\n", file, err.Error())
+				return subcommands.ExitFailure
+			}
+			objects = append(objects, link.Input{Name: file, Object: obj})
+		case binfmt.IsLibrary(data):
+			members, err := binfmt.DecodeLibrary(data)
+			if err != nil {
+				fmt.Printf("Invalid library %s - %s\n", file, err.Error())
+				return subcommands.ExitFailure
+			}
+			for _, m := range members {
+				libraries = append(libraries, link.Input{Name: file + "(" + m.Name + ")", Object: m.Object})
+			}
+		default:
+			fmt.Printf("%s is neither an object nor a library\n", file)
+			return subcommands.ExitFailure
+		}
+	}
+
+	var output []byte
+	if p.library {
+		var members []binfmt.Member
+		for _, in := range append(objects, libraries...) {
+			members = append(members, binfmt.Member{Name: in.Name, Object: in.Object})
+		}
+		output = binfmt.EncodeLibrary(members)
+	} else {
+		prog, errs := link.Link(objects, libraries, p.entry)
+		for _, err := range errs {
+			fmt.Printf("Error linking - %s\n", err.Error())
+		}
+		if len(errs) > 0 {
+			return subcommands.ExitFailure
+		}
+		output = prog.Encode()
+	}
+
+	err := ioutil.WriteFile(p.output, output, 0644)
+	if err != nil {
+		fmt.Printf("Error writing output file: %s\n", err.Error())
+		return subcommands.ExitFailure
+	}
+	return subcommands.ExitSuccess
+}
@@ -0,0 +1,38 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"gosc-vm/opcode"
+
+	"github.com/google/subcommands"
+)
+
+type opcodesCmd struct {
+}
+
+//
+// Glue
+//
+func (*opcodesCmd) Name() string     { return "opcodes" }
+func (*opcodesCmd) Synopsis() string { return "Describe the instruction set." }
+func (*opcodesCmd) Usage() string {
+	return `opcodes :
+  Show each instruction, with its opcode, syntax, and length, as markdown.
+`
+}
+
+//
+// Flag setup: no flags
+//
+func (p *opcodesCmd) SetFlags(f *flag.FlagSet) {
+}
+
+//
+// Entry-point.
+//
+func (p *opcodesCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	fmt.Print(opcode.Reference())
+	return subcommands.ExitSuccess
+}
@@ -13,6 +13,10 @@ import (
 )
 
 type runCmd struct {
+	include   stringList
+	defines   stringList
+	heapDebug bool
+	printInt  string
 }
 
 //
@@ -28,15 +32,25 @@ func (*runCmd) Usage() string {
 }
 
 //
-// Flag setup: no flags
+// Flag setup
 //
 func (p *runCmd) SetFlags(f *flag.FlagSet) {
+	f.Var(&p.include, "I", "A directory to search for included files, which may be given repeatedly.")
+	f.Var(&p.defines, "D", "Define a constant, as NAME=value, which may be given repeatedly.")
+	f.BoolVar(&p.heapDebug, "heap-debug", false, "Detect heap misuse, and report leaks on exit.")
+	f.StringVar(&p.printInt, "print-int", "hex", "How print_int shows integers: hex, decimal, or binary.")
 }
 
 //
 // Entry-point.
 //
 func (p *runCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	mode, ok := cpu.ParsePrintMode(p.printInt)
+	if !ok {
+		fmt.Printf("Unknown print mode %s\n", p.printInt)
+		return subcommands.ExitFailure
+	}
+
 	for _, file := range f.Args() {
 		fmt.Printf("Parsing file: %s\n", file)
 
@@ -48,20 +62,29 @@ func (p *runCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) s
 		}
 
 		// Lex it
-		l := lexer.New(string(input))
+		l := lexer.NewFile(file, string(input))
 
 		// Compile it
 		e := compiler.New(l)
+		e.SetIncludePath(p.include)
+		if !define(e, p.defines) {
+			return subcommands.ExitFailure
+		}
 		e.Compile()
 
 		// Now create a machine to run the compiled program in
 		c := cpu.NewCPU()
+		c.SetHeapDebug(p.heapDebug)
+		c.SetPrintMode(mode)
 
 		// Load the program
-		c.LoadBytes(e.Output())
+		c.LoadProgram(e.Program())
 
 		// Run the machine
-		c.Run()
+		if err := c.Run(); err != nil {
+			fmt.Printf("Error running %s - %s\n", file, err.Error())
+			return subcommands.ExitFailure
+		}
 	}
 	return subcommands.ExitSuccess
 }
@@ -0,0 +1,71 @@
+package main
+
+import (
+	"context"
+	"flag"
+	"fmt"
+	"gosc-vm/binfmt"
+	"gosc-vm/verify"
+	"io/ioutil"
+
+	"github.com/google/subcommands"
+)
+
+type verifyCmd struct {
+}
+
+//
+// Glue
+//
+func (*verifyCmd) Name() string     { return "verify" }
+func (*verifyCmd) Synopsis() string { return "Verify a simple.vm program." }
+func (*verifyCmd) Usage() string {
+	return `verify :
+  Check the bytecodes contained in the given input file, reporting any
+  unknown opcodes, truncated instructions, invalid registers, or bad
+  jump targets.
+`
+}
+
+//
+// Flag setup: no flags
+//
+func (p *verifyCmd) SetFlags(f *flag.FlagSet) {
+}
+
+//
+// Entry-point.
+//
+func (p *verifyCmd) Execute(_ context.Context, f *flag.FlagSet, _ ...interface{}) subcommands.ExitStatus {
+	status := subcommands.ExitSuccess
+	for _, file := range f.Args() {
+		prog, ok := loadVerified(file)
+		if !ok {
+			status = subcommands.ExitFailure
+			continue
+		}
+		fmt.Printf("%s: OK, %d bytes of code\n", file, len(prog.Code))
+	}
+	return status
+}
+
+// loadVerified loads, and verifies, the named program, reporting any
+// problems found.
+func loadVerified(file string) (*binfmt.Program, bool) {
+	data, err := ioutil.ReadFile(file)
+	if err != nil {
+		fmt.Printf("Error reading %s - %s\n", file, err.Error())
+		return nil, false
+	}
+	prog, err := binfmt.Load(data)
+	if err != nil {
+		fmt.Printf("Invalid program %s - %s\n", file, err.Error())
+		return nil, false
+	}
+
+	problems := verify.Program(prog)
+	for _, problem := range problems {
+		fmt.Printf("%s: %s\n", file, problem)
+	}
+	return prog, len(problems) == 0
+}
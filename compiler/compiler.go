@@ -1,731 +1,588 @@
 package compiler
 
 import (
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
+	"math"
 	"os"
+	"sort"
 	"strconv"
 	"strings"
 
+	"gosc-vm/binfmt"
+	"gosc-vm/include"
 	"gosc-vm/lexer"
+	"gosc-vm/macro"
 	"gosc-vm/opcode"
+	"gosc-vm/std"
 	"gosc-vm/token"
 )
 
 type Compiler struct {
-	l         *lexer.Lexer // our lexer
-	curToken  token.Token  //current token
-	peekToken token.Token  //next token
-	bytecode  []byte       // generated bytecode
-
-	labels map[string]int // holder for labels
-	fixups map[int]string // holder for fixups
+	l         *macro.Expander // our lexer, with macros expanded
+	files     *include.Reader // our lexer, with files included
+	file      string          // the name of the file being compiled
+	curToken  token.Token     //current token
+	peekToken token.Token     //next token
+	peeked    bool            // true once peekToken has been read
+	bytecode  []byte          // generated bytecode, of the current section
+
+	labels  map[string]int         // holder for labels
+	defs    map[string]token.Token // where each label is defined
+	used    map[string]bool        // the labels which are referred to
+	scope   string                 // the global label local ones belong to
+	numeric map[string]int         // how often each numeric label is defined
+	forward map[string]token.Token // references to numeric labels ahead
+	fixups  map[int]*fixup         // holder for fixups
+
+	constants  map[string]*expr // constants defined with .equ
+	evaluating map[string]bool  // constants being evaluated
+
+	inData      bool            // true while assembling into the data section
+	other       []byte          // the section we aren't assembling into
+	otherFixups map[int]*fixup  // and its fixups
+	dataLabels  map[string]bool // the labels defined in the data section
+
+	scopes []scope // register aliases, innermost scope last
+	blocks []block // blocks such as .if, innermost last
+	flows  int     // the number of structured blocks, for their labels
+
+	globals []string        // labels we export, for linking
+	externs map[string]bool // labels we import, for linking
+
+	uses    []string // modules of the standard library we use
+	library bool     // true while compiling the standard library
+	exports []string // the labels the module being compiled exports
+
+	entry      string        // label at which execution starts
+	absolute   bool          // true to encode branches with absolute addresses
+	absDefault bool          // the above, at the start of each file
+	features   uint16        // optional instructions we've used
+	fixed      bool          // true once we've branched to an absolute address
+	lines      []binfmt.Line // source-line of each instruction
 }
 
 // New is our constructor
 func New(l *lexer.Lexer) *Compiler {
-	p := &Compiler{l: l}
+	p := &Compiler{file: l.File()}
+	p.files = include.New(l)
+	p.l = macro.New(p.files)
 	p.labels = make(map[string]int)
-	p.fixups = make(map[int]string)
-
-	p.nextToken()
-	p.nextToken()
+	p.defs = make(map[string]token.Token)
+	p.used = make(map[string]bool)
+	p.numeric = make(map[string]int)
+	p.forward = make(map[string]token.Token)
+	p.fixups = make(map[int]*fixup)
+	p.otherFixups = make(map[int]*fixup)
+	p.dataLabels = make(map[string]bool)
+	p.constants = make(map[string]*expr)
+	p.evaluating = make(map[string]bool)
+	p.externs = make(map[string]bool)
 	return p
 }
 
-// nextToken gets the next token from our lexer-stream
-func (p *Compiler) nextToken() {
-	p.curToken = p.peekToken
-	p.peekToken = p.l.NextToken()
+// SetIncludePath sets the directories searched for files included with
+// ".include", after that of the file including them.
+func (p *Compiler) SetIncludePath(dirs []string) {
+	p.files.SetPath(dirs)
 }
 
-// isRegister returns true if the given string has a register ID
-func (p *Compiler) isRegister(input string) bool {
-	if strings.HasPrefix(input, "#") {
-		return true
-	}
-	return false
+// Define defines a constant, as though with .equ, such as one given on
+// our command-line.
+func (p *Compiler) Define(name string, value int) {
+	p.constants[name] = &expr{tok: token.Token{Type: token.INT, Literal: strconv.Itoa(value)}}
 }
 
-// getRegister converts a register string "#2" to an integer 2.
-func (p *Compiler) getRegister(input string) byte {
+// SetAbsolute sets whether jumps and calls are encoded with absolute
+// addresses, as they were before relative branches, rather than relative
+// ones, which allow our code to be loaded anywhere.
+func (p *Compiler) SetAbsolute(absolute bool) {
+	p.absDefault = absolute
+}
 
-	// TODO Check prefix is even present
-	num := strings.TrimPrefix(input, "#")
+// nextToken gets the next token from our lexer-stream
+func (p *Compiler) nextToken() {
+	p.peek()
+	p.curToken = p.peekToken
+	p.peeked = false
+}
 
-	// TODO: Bound-check register
-	i, err := strconv.Atoi(num)
-	if err == nil {
-		return byte(i)
-	} else {
-		panic(err)
+// peek reads the token after the current one, unless we have already.
+//
+// This is only done when needed, so that a directive such as .if is
+// handled before any macros which follow it are expanded, or defined.
+func (p *Compiler) peek() {
+	if !p.peeked {
+		p.peekToken = p.l.NextToken()
+		p.peeked = true
 	}
 }
 
 // Compile processe the stream of tokens from the lexer and builds
 // up the bytecode program.
 func (p *Compiler) Compile() {
-
-	// Until we get the end of our stream we'll process each token
-	// in turn, generating bytecode as we go.
-	for p.curToken.Type != token.EOF {
-
-		// Now handle the various tokens
-		switch p.curToken.Type {
-
-		case token.LABEL:
-			// Remove the ":" prefix from the label
-			label := strings.TrimPrefix(p.curToken.Literal, ":")
-			// The label points to the current point in our bytecode
-			p.labels[label] = len(p.bytecode)
-
-		case token.EXIT:
-			p.exitOp()
-
-		case token.INC:
-			p.incOp()
-
-		case token.DEC:
-			p.decOp()
-
-		case token.RANDOM:
-			p.randOp()
-
-		case token.RET:
-			p.retOp()
-
-		case token.CALL:
-			p.callOp()
-
-		case token.IS_INTEGER:
-			p.isIntOp()
-
-		case token.IS_STRING:
-			p.isStrOp()
-
-		case token.STRING2INT:
-			p.str2IntOp()
-
-		case token.INT2STRING:
-			p.int2StrOp()
-
-		case token.SYSTEM:
-			p.systemOp()
-
-		case token.CMP:
-			p.cmpOp()
-
-		case token.CONCAT:
-			p.concatOp()
-
-		case token.DB:
-			p.dataOp()
-
-		case token.DATA:
-			p.dataOp()
-
-		case token.GOTO:
-			p.jumpOp(opcode.JUMP_TO)
-
-		case token.JMP:
-			p.jumpOp(opcode.JUMP_TO)
-
-		case token.JMPZ:
-			p.jumpOp(opcode.JUMP_Z)
-
-		case token.JMPNZ:
-			p.jumpOp(opcode.JUMP_NZ)
-
-		case token.MEMCPY:
-			p.memcpyOp()
-
-		case token.NOP:
-			p.nopOp()
-
-		case token.PEEK:
-			p.peekOp()
-
-		case token.POKE:
-			p.pokeOp()
-
-		case token.PUSH:
-			p.pushOp()
-
-		case token.POP:
-			p.popOp()
-
-		case token.STORE:
-			p.storeOp()
-
-		case token.PRINT_INT:
-			p.printInt()
-
-		case token.PRINT_STR:
-			p.printString()
-
-		case token.ADD:
-			p.mathOperation(opcode.ADD_OP)
-
-		case token.SUB:
-			p.mathOperation(opcode.SUB_OP)
-
-		case token.MUL:
-			p.mathOperation(opcode.MUL_OP)
-
-		case token.DIV:
-			p.mathOperation(opcode.DIV_OP)
-
-		default:
-			fmt.Println("Unhandled token: ", p.curToken)
-
+	p.compile()
+
+	// The modules of the standard library we use follow our program,
+	// and may use further modules themselves.
+	p.library = true
+	for i := 0; i < len(p.uses); i++ {
+		src, _ := std.Source(p.uses[i])
+		p.l = macro.New(lexer.New(src))
+		p.exports = nil
+		p.compile()
+
+		for _, name := range p.exports {
+			addr, ok := p.labels[libraryPrefix+name]
+			if _, mine := p.labels[name]; ok && !mine {
+				p.labels[name] = addr
+			}
 		}
-		p.nextToken()
 	}
 
-	// Now fixup any label-names we've got to patch into place.
-	for addr, name := range p.fixups {
-		value := p.labels[name]
-		if value == 0 {
-			fmt.Printf("Use of undefined label '%s'\n", name)
-			os.Exit(1)
+	p.warnUnused()
+
+	// Now fixup any expressions we've got to patch into place, in the
+	// code and then the data.
+	for _, section := range []struct {
+		bytes  []byte
+		fixups map[int]*fixup
+	}{{p.bytecode, p.fixups}, {p.other, p.otherFixups}} {
+		for addr, f := range section.fixups {
+			value := p.place(p.eval(f.expr, false))
+			if len(value.syms) > 0 {
+				// this will be resolved by the linker
+				continue
+			}
+			p.patch(section.bytes, addr, f, value.n)
 		}
-
-		p1 := value % 256
-		p2 := (value - p1) / 256
-
-		p.bytecode[addr] = byte(p1)
-		p.bytecode[addr+1] = byte(p2)
 	}
 }
 
-// nopOp does nothing
-func (p *Compiler) nopOp() {
-	p.bytecode = append(p.bytecode, byte(opcode.NOP_OP))
-}
-
-// peekOp reads the contents of a memory address, and stores in a register
-func (p *Compiler) peekOp() {
-	// We're looking for an identifier next.
-	if !p.expectPeek(token.IDENT) {
-		return
-	}
-
-	res := p.getRegister(p.curToken.Literal)
-
-	// now we have a comma
-	if !p.expectPeek(token.COMMA) {
-		return
-	}
-	p.nextToken()
-
-	// and a literal
-	if p.curToken.Type != token.IDENT {
+// section switches between assembling into the data section, and the
+// code, which is the "text" section.
+//
+// The data section follows the code, so is writeable, but not executable.
+// Its labels are placed once the size of the code is known, and until
+// then their addresses may only be used relative to each other.
+func (p *Compiler) section(data bool) {
+	if data == p.inData {
 		return
 	}
-	addr := p.getRegister(p.curToken.Literal)
-
-	p.bytecode = append(p.bytecode, byte(opcode.PEEK))
-	p.bytecode = append(p.bytecode, byte(res))
-	p.bytecode = append(p.bytecode, byte(addr))
-
+	p.bytecode, p.other = p.other, p.bytecode
+	p.fixups, p.otherFixups = p.otherFixups, p.fixups
+	p.inData = data
 }
 
-// pokeOp writes to memory
-func (p *Compiler) pokeOp() {
-	// We're looking for an identifier next.
-	if !p.expectPeek(token.IDENT) {
-		return
+// place resolves the addresses of labels in the data section, now that
+// the code is complete.
+func (p *Compiler) place(v linear) linear {
+	if k, ok := v.syms[dataBase]; ok {
+		v.n += k * len(p.bytecode)
+		delete(v.syms, dataBase)
 	}
+	return v
+}
 
-	val := p.getRegister(p.curToken.Literal)
-
-	// now we have a comma
-	if !p.expectPeek(token.COMMA) {
-		return
-	}
+// compile processes the tokens from our lexer, until it is exhausted.
+func (p *Compiler) compile() {
+	p.scopes = []scope{{aliases: make(map[string]byte)}}
+	p.blocks = nil
+	p.scope = ""
+	p.absolute = p.absDefault
+	p.peeked = false
 	p.nextToken()
 
-	// and a literal
-	if p.curToken.Type != token.IDENT {
-		return
-	}
-	addr := p.getRegister(p.curToken.Literal)
-
-	p.bytecode = append(p.bytecode, byte(opcode.POKE))
-	p.bytecode = append(p.bytecode, byte(val))
-	p.bytecode = append(p.bytecode, byte(addr))
-}
+	// Until we get the end of our stream we'll process each token
+	// in turn, generating bytecode as we go.
+	for p.curToken.Type != token.EOF {
 
-// pushOp stores a stack-push
-func (p *Compiler) pushOp() {
-	// We're looking for an identifier next.
-	if !p.expectPeek(token.IDENT) {
-		return
-	}
+		// Now handle the various tokens
+		switch p.curToken.Type {
 
-	// Save the register we're storing to.
-	reg := p.getRegister(p.curToken.Literal)
+		case token.LABEL:
+			p.label(p.curToken)
 
-	p.bytecode = append(p.bytecode, byte(opcode.STACK_PUSH))
-	p.bytecode = append(p.bytecode, byte(reg))
-}
+		case token.INSTRUCTION:
+			p.instructionOp()
 
-// popOp stores a stack-push
-func (p *Compiler) popOp() {
-	// We're looking for an identifier next.
-	if !p.expectPeek(token.IDENT) {
-		return
-	}
+		case token.DIRECTIVE:
+			p.directiveOp()
 
-	// Save the register we're storing to.
-	reg := p.getRegister(p.curToken.Literal)
+		case token.DB:
+			p.dataOp(1)
 
-	p.bytecode = append(p.bytecode, byte(opcode.STACK_POP))
-	p.bytecode = append(p.bytecode, byte(reg))
-}
+		case token.DATA:
+			p.dataOp(1)
 
-// exitOp terminates our interpeter
-func (p *Compiler) exitOp() {
-	p.bytecode = append(p.bytecode, byte(opcode.EXIT))
-}
+		case token.ILLEGAL:
+			if strings.HasPrefix(p.curToken.Literal, ":") {
+				p.fail(p.curToken, "Invalid label '%s': names mustn't hold commas, nor operators such as '-'", p.curToken.Literal)
+			}
+			fallthrough
 
-// incOp increments the contents of the given register
-func (p *Compiler) incOp() {
+		default:
+			fmt.Printf("%s: Unhandled token: %s\n", p.curToken.Location(), p.curToken.Literal)
 
-	// We're looking for an identifier next.
-	if !p.expectPeek(token.IDENT) {
-		return
+		}
+		p.nextToken()
 	}
 
-	// Save the register we're storing to.
-	reg := p.getRegister(p.curToken.Literal)
-
-	p.bytecode = append(p.bytecode, byte(opcode.INC_OP))
-	p.bytecode = append(p.bytecode, byte(reg))
-}
+	// each file starts in the code
+	p.section(false)
 
-// decOp decrements the contents of the given register
-func (p *Compiler) decOp() {
-
-	// We're looking for an identifier next.
-	if !p.expectPeek(token.IDENT) {
-		return
+	if len(p.scopes) > 1 {
+		p.fail(p.scopes[len(p.scopes)-1].start, "Missing .endscope")
 	}
-
-	// Save the register we're storing to.
-	reg := p.getRegister(p.curToken.Literal)
-
-	p.bytecode = append(p.bytecode, byte(opcode.DEC_OP))
-	p.bytecode = append(p.bytecode, byte(reg))
-}
-
-// randOp returns a random value
-func (p *Compiler) randOp() {
-
-	// We're looking for an identifier next.
-	if !p.expectPeek(token.IDENT) {
-		return
+	if len(p.blocks) > 0 {
+		b := p.blocks[len(p.blocks)-1]
+		p.fail(b.start, "Missing %s", b.closer())
 	}
-
-	// Save the register we're storing to.
-	reg := p.getRegister(p.curToken.Literal)
-
-	p.bytecode = append(p.bytecode, byte(opcode.INT_RANDOM))
-	p.bytecode = append(p.bytecode, byte(reg))
+	for name, ref := range p.forward {
+		if _, ok := p.labels[name]; !ok {
+			p.fail(ref, "No label :%s follows %s", strings.TrimSuffix(ref.Literal, "f"), ref.Literal)
+		}
+	}
+	p.forward = make(map[string]token.Token)
 }
 
-// retOp returns from a call
-func (p *Compiler) retOp() {
-	p.bytecode = append(p.bytecode, byte(opcode.STACK_RET))
-}
+// instructionOp handles an instruction.
+//
+// The operands are collected, and then the instruction table is used to
+// find the opcode, sharing the mnemonic, whose operands match them.  For
+// example "store #1, 3" is an INT_STORE, while "store #1, #2" is a
+// REG_STORE.
+func (p *Compiler) instructionOp() {
+	tok := p.curToken
+	candidates := opcode.ByMnemonic(tok.Literal)
 
-// isStrOp tests if a register contains a string
-func (p *Compiler) isStrOp() {
-	// We're looking for an identifier next.
-	if !p.expectPeek(token.IDENT) {
-		return
+	// Collect the comma-separated operands, if this instruction
+	// takes any.
+	var operands []operand
+	if len(candidates[0].Operands) > 0 {
+		p.nextToken()
+		operands = append(operands, p.operand())
+		for p.peekTokenIs(token.COMMA) {
+			p.nextToken()
+			p.nextToken()
+			operands = append(operands, p.operand())
+		}
 	}
-
-	// Save the register we're storing to.
-	reg := p.getRegister(p.curToken.Literal)
-
-	p.bytecode = append(p.bytecode, byte(opcode.IS_STRING))
-	p.bytecode = append(p.bytecode, byte(reg))
+	p.assemble(tok, tok.Literal, operands...)
 }
 
-// str2IntOp converst the given string-register to an int.
-func (p *Compiler) str2IntOp() {
-	// We're looking for an identifier next.
-	if !p.expectPeek(token.IDENT) {
-		return
+// assemble outputs the instruction with the given mnemonic which suits
+// the given operands, written at tok.
+func (p *Compiler) assemble(tok token.Token, mnemonic string, operands ...operand) {
+	if p.inData {
+		p.fail(tok, "Instructions belong in the .text section, not .data")
 	}
-
-	// Save the register we're storing to.
-	reg := p.getRegister(p.curToken.Literal)
-
-	p.bytecode = append(p.bytecode, byte(opcode.STRING_TOINT))
-	p.bytecode = append(p.bytecode, byte(reg))
-}
-
-// int2StrOp converst the given int-register to a string.
-func (p *Compiler) int2StrOp() {
-	// We're looking for an identifier next.
-	if !p.expectPeek(token.IDENT) {
-		return
+	if !p.library && tok.File == p.file {
+		// only the lines of our own source are recorded, as
+		// the line table has no room for the names of others
+		p.lines = append(p.lines, binfmt.Line{Addr: len(p.bytecode), Line: tok.Line})
 	}
 
-	// Save the register we're storing to.
-	reg := p.getRegister(p.curToken.Literal)
-
-	p.bytecode = append(p.bytecode, byte(opcode.INT_TOSTRING))
-	p.bytecode = append(p.bytecode, byte(reg))
-}
-
-// systemOp runs the (string) command in the given register
-func (p *Compiler) systemOp() {
-	// We're looking for an identifier next.
-	if !p.expectPeek(token.IDENT) {
-		return
+	candidates := opcode.ByMnemonic(mnemonic)
+	for _, ins := range candidates {
+		if p.operandsMatch(ins, operands) {
+			p.emit(ins, operands)
+			return
+		}
 	}
 
-	// Save the register
-	reg := p.getRegister(p.curToken.Literal)
-
-	p.bytecode = append(p.bytecode, byte(opcode.STRING_SYSTEM))
-	p.bytecode = append(p.bytecode, byte(reg))
-}
-
-// isIntOp tests if a register contains an integer
-func (p *Compiler) isIntOp() {
-	// We're looking for an identifier next.
-	if !p.expectPeek(token.IDENT) {
-		return
+	var literals []string
+	for _, op := range operands {
+		literals = append(literals, op.String())
 	}
-
-	// Save the register we're storing to.
-	reg := p.getRegister(p.curToken.Literal)
-
-	p.bytecode = append(p.bytecode, byte(opcode.IS_INTEGER))
-	p.bytecode = append(p.bytecode, byte(reg))
-}
-
-// callOp generates a call instruction
-func (p *Compiler) callOp() {
-
-	// add the call instruction
-	p.bytecode = append(p.bytecode, byte(opcode.STACK_CALL))
-	// advance to the target
-	p.nextToken()
-
-	// The call might be to an absolute target, or a label.
-	switch p.curToken.Type {
-
-	case token.INT:
-		addr, _ := strconv.Atoi(p.curToken.Literal)
-		len1 := addr % 256
-		len2 := (addr - len1) / 256
-
-		p.bytecode = append(p.bytecode, byte(len1))
-		p.bytecode = append(p.bytecode, byte(len2))
-
-	case token.IDENT:
-
-		// Record that we have to fixup this thing
-		p.fixups[len(p.bytecode)] = p.curToken.Literal
-
-		// output two temporary numbers
-		p.bytecode = append(p.bytecode, byte(0))
-		p.bytecode = append(p.bytecode, byte(0))
+	fmt.Printf("ERROR: %s: Invalid operands for %s: %s\n", tok.Location(), mnemonic, strings.Join(literals, ", "))
+	for _, ins := range candidates {
+		fmt.Printf("\texpected: %s\n", ins.Syntax())
 	}
-
+	os.Exit(1)
 }
 
-// jumpOp inserts a direct jump
-func (p *Compiler) jumpOp(operator int) {
-
-	// add the jump
-	p.bytecode = append(p.bytecode, byte(operator))
-
-	// advance to the target
-	p.nextToken()
-
-	// The jump might be an absolute target, or a label.
-	switch p.curToken.Type {
-
-	case token.INT:
-		addr, _ := strconv.Atoi(p.curToken.Literal)
-		len1 := addr % 256
-		len2 := (addr - len1) / 256
-
-		p.bytecode = append(p.bytecode, byte(len1))
-		p.bytecode = append(p.bytecode, byte(len2))
-
-	case token.IDENT:
-
-		// Record that we have to fixup this thing
-		p.fixups[len(p.bytecode)] = p.curToken.Literal
+// operand is an operand of an instruction: a register, string or float,
+// or else an integer expression.
+type operand struct {
+	tok  token.Token
+	expr *expr
+}
 
-		// output two temporary numbers
-		p.bytecode = append(p.bytecode, byte(0))
-		p.bytecode = append(p.bytecode, byte(0))
+// String returns the operand as it was written.
+func (op operand) String() string {
+	if op.expr != nil {
+		return op.expr.String()
 	}
-
+	return op.tok.Literal
 }
 
-// memcpyOp inserts a memcopy operation.
-func (p *Compiler) memcpyOp() {
-	p.nextToken()
-
-	one := p.getRegister(p.curToken.Literal)
-
-	if !p.expectPeek(token.COMMA) {
-		return
+// operand reads the operand starting at the current token.
+func (p *Compiler) operand() operand {
+	tok := p.curToken
+	if tok.Type == token.MINUS && p.peekTokenIs(token.FLOAT) {
+		// a negative float, which isn't an expression
+		p.nextToken()
+		tok.Type = token.FLOAT
+		tok.Literal = "-" + p.curToken.Literal
 	}
-
-	p.nextToken()
-	two := p.getRegister(p.curToken.Literal)
-
-	if !p.expectPeek(token.COMMA) {
-		return
+	if tok.Type == token.STRING || tok.Type == token.FLOAT || (tok.Type == token.IDENT && p.isRegister(tok.Literal)) {
+		return operand{tok: tok}
 	}
-	p.nextToken()
-
-	three := p.getRegister(p.curToken.Literal)
-
-	// output the bytecode
-	p.bytecode = append(p.bytecode, byte(opcode.MEMCPY))
-	p.bytecode = append(p.bytecode, byte(one))
-	p.bytecode = append(p.bytecode, byte(two))
-	p.bytecode = append(p.bytecode, byte(three))
+	return operand{tok: tok, expr: p.expression()}
 }
 
-// mathOperation handles add/sub/mul/div/etc
-func (p *Compiler) mathOperation(operation int) {
-
-	// We're looking for an identifier next.
-	if !p.expectPeek(token.IDENT) {
-		return
-	}
-
-	// dest
-	dst := p.getRegister(p.curToken.Literal)
+// operandsMatch returns true if the given operands are suitable for the
+// given instruction.
+func (p *Compiler) operandsMatch(ins *opcode.Instruction, operands []operand) bool {
+	kinds := ins.Operands
 
-	// now we have a comma
-	if !p.expectPeek(token.COMMA) {
-		return
+	// A register-list consumes all the remaining operands.
+	if len(kinds) > 0 && kinds[len(kinds)-1] == opcode.RegList {
+		if len(operands) < len(kinds)-1 {
+			return false
+		}
+		for _, op := range operands[len(kinds)-1:] {
+			if !p.operandIs(ins, opcode.Reg, op) {
+				return false
+			}
+		}
+		kinds = kinds[:len(kinds)-1]
+		operands = operands[:len(kinds)]
 	}
-	p.nextToken()
 
-	// and a literal
-	if p.curToken.Type != token.IDENT {
-		return
+	if len(kinds) != len(operands) {
+		return false
 	}
-	src1 := p.getRegister(p.curToken.Literal)
-
-	// and a comma
-	if !p.expectPeek(token.COMMA) {
-		return
+	for i, kind := range kinds {
+		if !p.operandIs(ins, kind, operands[i]) {
+			return false
+		}
 	}
-	p.nextToken()
-
-	// and a final literal
-	if p.curToken.Type != token.IDENT {
-		return
+	return true
+}
+
+// operandIs returns true if the given operand can be used as an operand
+// of the given kind.
+func (p *Compiler) operandIs(ins *opcode.Instruction, kind opcode.Operand, op operand) bool {
+	tok := op.tok
+	switch kind {
+	case opcode.Reg:
+		return op.expr == nil && tok.Type == token.IDENT && p.isRegister(tok.Literal)
+	case opcode.Imm16, opcode.Addr, opcode.Byte:
+		// an integer expression, which may use labels and
+		// constants, or a byte's value name, e.g. "hex"
+		return op.expr != nil
+	case opcode.Rel:
+		// an address, which is relative unless we've been asked
+		// otherwise, or it lies in another object
+		return op.expr != nil && !p.absolute && !p.external(op.expr)
+	case opcode.Str:
+		return tok.Type == token.STRING
+	case opcode.Float:
+		return tok.Type == token.FLOAT
 	}
-	src2 := p.getRegister(p.curToken.Literal)
-
-	p.bytecode = append(p.bytecode, byte(operation))
-	p.bytecode = append(p.bytecode, byte(dst))
-	p.bytecode = append(p.bytecode, byte(src1))
-	p.bytecode = append(p.bytecode, byte(src2))
-
+	return false
 }
 
-// storeOp handles loading a register with a string, integer, or register,
-// or label-address.
-func (p *Compiler) storeOp() {
-
-	// We're looking for an identifier next.
-	if !p.expectPeek(token.IDENT) {
-		return
-	}
-
-	// Save the register we're storing to.
-	reg := p.getRegister(p.curToken.Literal)
-
-	if !p.expectPeek(token.COMMA) {
-		return
-	}
-	p.nextToken()
-
-	// Now we know where we're storing the thing we need to determine
-	// what is being stored: string, integer, register value, or a
-	// label address.
-	switch p.curToken.Type {
-
-	case token.STRING:
-		// STRING_STORE $REG $LEN1 $LEN2 $STRING
-		p.bytecode = append(p.bytecode, byte(opcode.STRING_STORE))
-		p.bytecode = append(p.bytecode, reg)
-
-		len := len(p.curToken.Literal)
-
-		len1 := len % 256
-		len2 := (len - len1) / 256
-		p.bytecode = append(p.bytecode, byte(len1))
-		p.bytecode = append(p.bytecode, byte(len2))
-
-		// output the length
-		for i := 0; i < len; i++ {
-			p.bytecode = append(p.bytecode, byte(p.curToken.Literal[i]))
-		}
-	case token.INT:
-		// INT_STORE $REG $NUM1 NUM2
-		p.bytecode = append(p.bytecode, byte(opcode.INT_STORE))
-		p.bytecode = append(p.bytecode, reg)
-
-		// Convert to low/high
-		i, _ := strconv.Atoi(p.curToken.Literal)
-
-		len1 := i % 256
-		len2 := (i - len1) / 256
-		p.bytecode = append(p.bytecode, byte(len1))
-		p.bytecode = append(p.bytecode, byte(len2))
-	case token.IDENT:
-		if p.isRegister(p.curToken.Literal) {
-			// REG_STORE REG_DST REG_SRC
-			p.bytecode = append(p.bytecode, byte(opcode.REG_STORE))
-			p.bytecode = append(p.bytecode, reg)
-			p.bytecode = append(p.bytecode, p.getRegister(p.curToken.Literal))
-		} else {
-			// Here we're storing the address of a label.
-
-			// INT_STORE $REG $NUM1 $NUM2
-			p.bytecode = append(p.bytecode, byte(opcode.INT_STORE))
-			p.bytecode = append(p.bytecode, reg)
-
-			// record that we need a fixup here
-			p.fixups[len(p.bytecode)] = p.curToken.Literal
-
-			// output two temporary numbers
-			p.bytecode = append(p.bytecode, byte(0))
-			p.bytecode = append(p.bytecode, byte(0))
+// emit outputs the bytecode for the given instruction and operands.
+func (p *Compiler) emit(ins *opcode.Instruction, operands []operand) {
+	p.bytecode = append(p.bytecode, ins.Code)
+	p.features |= ins.Features()
+
+	for i, kind := range ins.Operands {
+		switch kind {
+		case opcode.Reg:
+			p.bytecode = append(p.bytecode, p.getRegister(operands[i].tok))
+
+		case opcode.Imm16, opcode.Addr:
+			if kind == opcode.Addr {
+				p.fixed = true
+			}
+			p.value(operands[i].expr, 2, 0)
+
+		case opcode.Rel:
+			p.relative(operands[i].expr)
+
+		case opcode.Byte:
+			e := operands[i].expr
+			if val, ok := ins.Values[e.tok.Literal]; ok && e.right == nil {
+				p.bytecode = append(p.bytecode, byte(val))
+				continue
+			}
+			p.value(e, 1, 0)
+
+		case opcode.Str:
+			p.stringLiteral(operands[i].tok.Literal)
+
+		case opcode.Float:
+			tok := operands[i].tok
+			f, err := strconv.ParseFloat(tok.Literal, 64)
+			if err != nil {
+				p.fail(tok, "Invalid float: %s", tok.Literal)
+			}
+
+			var buf [8]byte
+			binary.LittleEndian.PutUint64(buf[:], math.Float64bits(f))
+			p.bytecode = append(p.bytecode, buf[:]...)
+
+		case opcode.RegList:
+			regs := operands[i:]
+			if len(regs) > 255 {
+				p.fail(regs[0].tok, "Too many registers for %s: %d", ins.Mnemonic, len(regs))
+			}
+			p.bytecode = append(p.bytecode, byte(len(regs)))
+			for _, op := range regs {
+				p.bytecode = append(p.bytecode, p.getRegister(op.tok))
+			}
 		}
-	default:
-		fmt.Printf("ERROR: Invalid thing to store: %v\n", p.curToken)
-		os.Exit(1)
 	}
 }
 
-// cmpOp handles comparing a register with a string, integer, or register,
-// or label-address.
-func (p *Compiler) cmpOp() {
-
-	// We're looking for an identifier next.
-	if !p.expectPeek(token.IDENT) {
-		return
-	}
-
-	// Save the register we're storing to.
-	reg := p.getRegister(p.curToken.Literal)
-
-	if !p.expectPeek(token.COMMA) {
-		return
+// stringLiteral outputs a string, prefixed by its length in bytes.
+// The string is output as-is, so UTF-8 text is preserved.
+func (p *Compiler) stringLiteral(str string) {
+	if len(str) > 0xFFFF {
+		fmt.Printf("ERROR: String literal too long: %d bytes\n", len(str))
+		os.Exit(1)
 	}
-	p.nextToken()
 
-	// Now we know what source register we're comparing we need to see
-	// if that comparision is with a string, integer, register value, or a
-	// label address.
-	switch p.curToken.Type {
-
-	case token.STRING:
-		// CMP_STRING $REG $LEN1 $LEN2 $STRING
-		p.bytecode = append(p.bytecode, byte(opcode.CMP_STRING))
-		p.bytecode = append(p.bytecode, reg)
-
-		len := len(p.curToken.Literal)
-
-		len1 := len % 256
-		len2 := (len - len1) / 256
-		p.bytecode = append(p.bytecode, byte(len1))
-		p.bytecode = append(p.bytecode, byte(len2))
-
-		// append the string
-		for i := 0; i < len; i++ {
-			p.bytecode = append(p.bytecode, byte(p.curToken.Literal[i]))
-		}
-	case token.INT:
-		// CMP_IMMEDIATE $REG $NUM1 NUM2
-		p.bytecode = append(p.bytecode, byte(opcode.CMP_IMMEDIATE))
-		p.bytecode = append(p.bytecode, reg)
-
-		// Convert to low/high
-		i, _ := strconv.Atoi(p.curToken.Literal)
-
-		len1 := i % 256
-		len2 := (i - len1) / 256
-		p.bytecode = append(p.bytecode, byte(len1))
-		p.bytecode = append(p.bytecode, byte(len2))
-	case token.IDENT:
-		if p.isRegister(p.curToken.Literal) {
-			// CMP_REG REG_DST REG_SRC
-			p.bytecode = append(p.bytecode, byte(opcode.CMP_REG))
-			p.bytecode = append(p.bytecode, reg)
-			p.bytecode = append(p.bytecode, p.getRegister(p.curToken.Literal))
+	len1 := len(str) % 256
+	len2 := (len(str) - len1) / 256
+	p.bytecode = append(p.bytecode, byte(len1))
+	p.bytecode = append(p.bytecode, byte(len2))
+
+	p.bytecode = append(p.bytecode, str...)
+}
+
+// directiveOp handles an assembler directive.
+func (p *Compiler) directiveOp() {
+	switch p.curToken.Literal {
+	case ".reg", ".unreg", ".scope", ".endscope":
+		p.regOp()
+	case ".if", ".ifdef", ".ifndef", ".else", ".endif":
+		p.condOp()
+	case ".while", ".endwhile", ".for", ".next", ".break", ".continue":
+		p.flowOp(p.l.Rest(p.curToken))
+	case ".data":
+		p.section(true)
+	case ".text":
+		p.section(false)
+	case ".entry":
+		// the label at which execution starts, unless SetEntry has
+		// chosen another
+		p.nextToken()
+		if p.curToken.Type != token.IDENT && p.curToken.Type != token.INSTRUCTION {
+			p.fail(p.curToken, "Expected a label name, got '%s'", p.curToken.Literal)
+		}
+		if p.entry == "" {
+			p.entry = p.curToken.Literal
+		}
+	case ".include":
+		// one read ahead of an .if, which is assembled after all
+		dir := p.curToken
+		p.nextToken()
+		p.files.Include(dir, p.curToken)
+	case ".byte":
+		p.dataOp(1)
+	case ".word":
+		p.dataOp(2)
+	case ".dword":
+		p.dataOp(4)
+	case ".ascii", ".asciz":
+		// strings, without a length, the latter terminated by a zero
+		dir := p.curToken
+		for {
+			p.nextToken()
+			if !p.curTokenIs(token.STRING) {
+				p.fail(p.curToken, "Expected a string, got '%s'", p.curToken.Literal)
+			}
+			p.bytecode = append(p.bytecode, p.curToken.Literal...)
+			if dir.Literal == ".asciz" {
+				p.bytecode = append(p.bytecode, 0)
+			}
+			if !p.peekTokenIs(token.COMMA) {
+				break
+			}
+			p.nextToken()
+		}
+	case ".space", ".align", ".org":
+		p.spaceOp()
+	case ".absolute", ".relative":
+		// how the jumps and calls which follow are encoded
+		p.absolute = p.curToken.Literal == ".absolute"
+	case ".global":
+		// labels we define, which other objects may use.  Those of
+		// the standard library are private to each program which
+		// uses it.
+		names := p.nameList()
+		if p.library {
+			p.exports = append(p.exports, names...)
 		} else {
-			// Here we're storing the address of a label.
-
-			// INT_STORE $REG $NUM1 $NUM2
-			p.bytecode = append(p.bytecode, byte(opcode.CMP_IMMEDIATE))
-			p.bytecode = append(p.bytecode, reg)
-
-			// record that we need a fixup here
-			p.fixups[len(p.bytecode)] = p.curToken.Literal
+			p.globals = append(p.globals, names...)
+		}
+	case ".extern":
+		// labels other objects define, which we use
+		for _, name := range p.nameList() {
+			p.externs[name] = true
+		}
+	case ".use":
+		// a module of the standard library
+		p.nextToken()
+		name := p.curToken.Literal
+		if _, ok := std.Source(name); !ok || !p.curTokenIs(token.STRING) {
+			p.fail(p.curToken, "Unknown module '%s', expected one of %s", name, strings.Join(std.Modules(), ", "))
+		}
+		for _, used := range p.uses {
+			if used == name {
+				return
+			}
+		}
+		p.uses = append(p.uses, name)
+	case ".equ", ".const":
+		// a constant, whose value is an expression
+		p.nextToken()
+		name := p.curToken
+		if (name.Type != token.IDENT && name.Type != token.INSTRUCTION) || p.isRegister(name.Literal) {
+			p.fail(name, "Expected the name of a constant, got '%s'", name.Literal)
+		}
+		if p.peekTokenIs(token.COMMA) || p.peekTokenIs(token.ASSIGN) {
+			p.nextToken()
+		}
+		p.nextToken()
+		value := p.expression()
 
-			// output two temporary numbers
-			p.bytecode = append(p.bytecode, byte(0))
-			p.bytecode = append(p.bytecode, byte(0))
+		_, label := p.labels[name.Literal]
+		if _, ok := p.constants[name.Literal]; ok || label {
+			p.fail(name, "'%s' is already defined", name.Literal)
 		}
-	default:
-		fmt.Printf("ERROR: Invalid thing to store: %v\n", p.curToken)
-		os.Exit(1)
+		p.constants[name.Literal] = value
 	}
 }
 
-// concatOp concatenates two string values.
-func (p *Compiler) concatOp() {
-	p.nextToken()
-
-	dst := p.getRegister(p.curToken.Literal)
-
-	if !p.expectPeek(token.COMMA) {
-		return
-	}
-
-	p.nextToken()
-	a := p.getRegister(p.curToken.Literal)
-
-	if !p.expectPeek(token.COMMA) {
-		return
+// nameList reads a comma-separated list of label names.
+func (p *Compiler) nameList() []string {
+	var names []string
+	for {
+		p.nextToken()
+		if p.curToken.Type != token.IDENT && p.curToken.Type != token.INSTRUCTION {
+			p.fail(p.curToken, "Expected a label name, got '%s'", p.curToken.Literal)
+		}
+		names = append(names, p.curToken.Literal)
+		if !p.peekTokenIs(token.COMMA) {
+			return names
+		}
+		p.nextToken()
 	}
-	p.nextToken()
-
-	b := p.getRegister(p.curToken.Literal)
-
-	// output the bytecode
-	p.bytecode = append(p.bytecode, byte(opcode.STRING_CONCAT))
-	p.bytecode = append(p.bytecode, byte(dst))
-	p.bytecode = append(p.bytecode, byte(a))
-	p.bytecode = append(p.bytecode, byte(b))
 }
 
-// dataOp embeds literal/binary data into the output
-func (p *Compiler) dataOp() {
+// dataOp embeds literal/binary data into the output, as values of the
+// given size in bytes, which may be the addresses of labels.
+func (p *Compiler) dataOp(size int) {
+	min := -1 << (8*size - 1)
 	p.nextToken()
-	db := p.curToken.Literal
-	i, _ := strconv.ParseInt(db, 0, 64)
-	p.bytecode = append(p.bytecode, byte(i))
+	p.value(p.expression(), size, min)
 
 	//
 	// Loop looking for more data - we don't know how much
@@ -735,37 +592,42 @@ func (p *Compiler) dataOp() {
 		// skip the comma
 		p.nextToken()
 
-		// read the next int
-		if p.expectPeek(token.INT) {
-			db := p.curToken.Literal
-			i, _ := strconv.ParseInt(db, 0, 64)
-			p.bytecode = append(p.bytecode, byte(i))
-		}
+		// read the next value, which may be negative
+		p.nextToken()
+		p.value(p.expression(), size, min)
 	}
 }
 
-// Handle printing the contents of a register as an integer.
-func (p *Compiler) printInt() {
+// spaceOp handles the directives which reserve space, filled with zeros:
+//
+//	.space 16    sixteen bytes
+//	.align 4     up to a multiple of four bytes
+//	.org 0x100   up to the given address
+//
+// In an object, addresses are relative to the start of the object, and
+// in the data section, to the start of that.
+func (p *Compiler) spaceOp() {
+	dir := p.curToken
+	p.nextToken()
+	n := p.constant(p.expression())
 
-	// We're looking for an identifier next.
-	if !p.expectPeek(token.IDENT) {
-		return
+	size := n
+	switch dir.Literal {
+	case ".align":
+		if n < 1 {
+			p.fail(dir, "Invalid alignment: %d", n)
+		}
+		size = (n - len(p.bytecode)%n) % n
+	case ".org":
+		if n < len(p.bytecode) {
+			p.fail(dir, "Cannot move back to %04X from %04X", n, len(p.bytecode))
+		}
+		size = n - len(p.bytecode)
 	}
-
-	p.bytecode = append(p.bytecode, byte(opcode.INT_PRINT))
-	p.bytecode = append(p.bytecode, p.getRegister(p.curToken.Literal))
-}
-
-// Handle printing the contents of a register as a string.
-func (p *Compiler) printString() {
-
-	// We're looking for an identifier next.
-	if !p.expectPeek(token.IDENT) {
-		return
+	if size < 0 || len(p.bytecode)+size > 0xFFFF {
+		p.fail(dir, "Invalid size for %s: %d", dir.Literal, n)
 	}
-
-	p.bytecode = append(p.bytecode, byte(opcode.STRING_PRINT))
-	p.bytecode = append(p.bytecode, p.getRegister(p.curToken.Literal))
+	p.bytecode = append(p.bytecode, make([]byte, size)...)
 }
 
 // determinate current token is t or not.
@@ -775,6 +637,7 @@ func (p *Compiler) curTokenIs(t token.TokenType) bool {
 
 // determinate next token is t or not
 func (p *Compiler) peekTokenIs(t token.TokenType) bool {
+	p.peek()
 	return p.peekToken.Type == t
 }
 
@@ -796,10 +659,150 @@ func (p *Compiler) peekError(t token.TokenType) {
 	os.Exit(1)
 }
 
-// Write outputs our generated bytecode to the named file.
+// fail reports an error in the given token, and exits.
+func (p *Compiler) fail(tok token.Token, format string, args ...interface{}) {
+	fmt.Printf("ERROR: %s: %s\n", tok.Location(), fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
+
+// SetEntry sets the label at which execution should start, rather than
+// the start of the program, or the label of an .entry directive.
+func (p *Compiler) SetEntry(label string) {
+	p.entry = label
+}
+
+// Program returns our generated bytecode as a program, along with the
+// symbols and source-lines needed for debugging.
+//
+// A program which uses external labels must be compiled as an object,
+// and linked, instead.
+func (p *Compiler) Program() *binfmt.Program {
+	for _, fixups := range []map[int]*fixup{p.fixups, p.otherFixups} {
+		for _, f := range fixups {
+			for name := range p.place(p.eval(f.expr, false)).syms {
+				p.fail(f.expr.tok, "Use of external label '%s' - compile as an object, and link", name)
+			}
+		}
+	}
+	return p.program()
+}
+
+// Object returns our generated bytecode as a relocatable object, for
+// linking with others.
+func (p *Compiler) Object() *binfmt.Object {
+	if len(p.other) > 0 || len(p.dataLabels) > 0 {
+		fmt.Printf("Objects may not have a .data section, which the linker cannot place\n")
+		os.Exit(1)
+	}
+	obj := &binfmt.Object{Program: *p.program()}
+	obj.Entry = 0
+	obj.Code = append([]byte{}, p.bytecode...)
+
+	for _, name := range p.globals {
+		if _, ok := p.labels[name]; !ok {
+			fmt.Printf("Export of undefined label '%s'\n", name)
+			os.Exit(1)
+		}
+		obj.Exports = append(obj.Exports, name)
+	}
+
+	// Every reference to a label must be relocated, by adding its
+	// address to the rest of the expression.
+	for addr, f := range p.fixups {
+		value := p.eval(f.expr, true)
+		if len(value.syms) == 0 {
+			continue
+		}
+		if f.relative {
+			if len(value.syms) == 1 && value.syms[""] == 1 {
+				// relative to our own code, so it's already
+				// been patched
+				continue
+			}
+			p.fail(f.expr.tok, "Cannot branch relative to %s - declare it with .extern first", f.expr)
+		}
+		for name, k := range value.syms {
+			if len(value.syms) > 1 || k != 1 || f.size != 2 {
+				p.fail(f.expr.tok, "Cannot relocate %s - it must be a label's address, plus or minus a constant", f.expr)
+			}
+			addend := value.n
+			if name == "" {
+				// relative to one of our own labels
+				name = value.local
+				addend -= p.labels[name]
+			}
+			obj.Relocs = append(obj.Relocs, binfmt.Reloc{Offset: addr, Symbol: name})
+			p.patch(obj.Code, addr, &fixup{expr: f.expr, size: f.size, min: -0x8000}, addend)
+		}
+	}
+	sort.Slice(obj.Relocs, func(i, j int) bool { return obj.Relocs[i].Offset < obj.Relocs[j].Offset })
+	return obj
+}
+
+// program builds a program from our generated bytecode.
+func (p *Compiler) program() *binfmt.Program {
+	prog := &binfmt.Program{
+		Version:  binfmt.Version,
+		Features: p.features,
+		Code:     p.bytecode,
+		Data:     p.other,
+		Lines:    p.lines,
+		Movable:  p.movable(),
+	}
+
+	if p.entry != "" {
+		addr, ok := p.labels[p.entry]
+		if !ok {
+			fmt.Printf("Use of undefined label '%s' as entry point\n", p.entry)
+			os.Exit(1)
+		}
+		prog.Entry = addr
+	}
+
+	for name, addr := range p.labels {
+		if p.dataLabels[name] {
+			addr += len(p.bytecode)
+		}
+		prog.Symbols = append(prog.Symbols, binfmt.Symbol{Name: name, Addr: addr})
+	}
+	sort.Slice(prog.Symbols, func(i, j int) bool {
+		a, b := prog.Symbols[i], prog.Symbols[j]
+		if a.Addr != b.Addr {
+			return a.Addr < b.Addr
+		}
+		if x, y := strings.Contains(a.Name, "@"), strings.Contains(b.Name, "@"); x != y {
+			// names as written first, such as those the
+			// standard library exports
+			return y
+		}
+		return a.Name < b.Name
+	})
+	return prog
+}
+
+// movable returns true if our code may be loaded at any address, as it
+// holds no absolute addresses: we've only branched to relative ones, and
+// no value is the address of a label, unless it's offset by another, as
+// in "end - start".
+func (p *Compiler) movable() bool {
+	if p.fixed {
+		return false
+	}
+	for _, fixups := range []map[int]*fixup{p.fixups, p.otherFixups} {
+		for _, f := range fixups {
+			if !f.relative && len(p.eval(f.expr, true).syms) > 0 {
+				return false
+			}
+		}
+	}
+	return true
+}
+
+// Write outputs our generated program to the named file.
 func (p *Compiler) Write(output string) {
+	data := p.Program().Encode()
 	fmt.Printf("Our bytecode is %d bytes long\n", len(p.bytecode))
-	err := ioutil.WriteFile(output, p.bytecode, 0644)
+	err := ioutil.WriteFile(output, data, 0644)
 	if err != nil {
 		fmt.Printf("Error writing output file: %s\n", err.Error())
 		os.Exit(1)
@@ -0,0 +1,352 @@
+package compiler
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gosc-vm/lexer"
+	"gosc-vm/opcode"
+)
+
+// sampleOperand returns assembly for an operand of the given kind, and
+// the value it should decode to.
+func sampleOperand(kind opcode.Operand, i int) (string, opcode.Arg) {
+	switch kind {
+	case opcode.Reg:
+		return fmt.Sprintf("#%d", i+1), opcode.Arg{Int: i + 1}
+	case opcode.Imm16, opcode.Addr, opcode.Rel:
+		return "0x1234", opcode.Arg{Int: 0x1234}
+	case opcode.Byte:
+		return "2", opcode.Arg{Int: 2}
+	case opcode.Str:
+		return `"héllo"`, opcode.Arg{Str: "héllo"}
+	case opcode.Float:
+		return "2.5", opcode.Arg{Float: 2.5}
+	}
+	return "#7, #8", opcode.Arg{Regs: []byte{7, 8}}
+}
+
+// TestRoundTrip compiles each instruction in our table, and ensures that
+// decoding the result gives the same opcode and operands.
+func TestRoundTrip(t *testing.T) {
+	for _, ins := range opcode.Table {
+		var ops []string
+		var want []opcode.Arg
+		for i, kind := range ins.Operands {
+			src, arg := sampleOperand(kind, i)
+			ops = append(ops, src)
+			want = append(want, arg)
+		}
+		src := ins.Mnemonic + " " + strings.Join(ops, ", ")
+		for _, kind := range ins.Operands {
+			if kind == opcode.Addr {
+				// we'd otherwise prefer the relative encoding
+				src = ".absolute\n" + src
+			}
+		}
+
+		c := New(lexer.New(src))
+		c.Compile()
+		out := c.Output()
+
+		d, ok := opcode.Decode(func(addr int) byte { return out[addr] }, 0)
+		if !ok || d.Code != ins.Code {
+			t.Errorf("%s: compiled to %02X, not %02X", src, out[0], ins.Code)
+			continue
+		}
+		if d.Length != len(out) {
+			t.Errorf("%s: decoded length %d, but compiled to %d bytes", src, d.Length, len(out))
+		}
+		if fmt.Sprint(d.Args) != fmt.Sprint(want) {
+			t.Errorf("%s: decoded %v, not %v", src, d.Args, want)
+		}
+	}
+}
+
+func TestExpressions(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected []byte
+	}{
+		{"store #1, 2 + 3 * 4", []byte{0x01, 0x01, 14, 0}},
+		{"store #1, (2 + 3) * 4", []byte{0x01, 0x01, 20, 0}},
+		{"store #1, 10 - 2 - 3", []byte{0x01, 0x01, 5, 0}},
+		{"store #1, 0x100/2", []byte{0x01, 0x01, 0x80, 0}},
+		{".equ MAX 100\ncmp #2, MAX * 2", []byte{0x41, 0x02, 200, 0}},
+		{".const A, B + 1\n.equ B 2\nstore #1, -A + 5", []byte{0x01, 0x01, 2, 0}},
+		{".equ MODE 1\nprint_mode MODE", []byte{0x06, 1}},
+		{":start\nstore #1, end - start\n:end", []byte{0x01, 0x01, 4, 0}},
+		{"store #1, buffer + 16\n:buffer", []byte{0x01, 0x01, 20, 0}},
+		{"DB 1, -1, 2 * 3", []byte{1, 0xFF, 6}},
+	}
+
+	for _, tt := range tests {
+		c := New(lexer.New(tt.input))
+		c.Compile()
+		if fmt.Sprint(c.Output()) != fmt.Sprint(tt.expected) {
+			t.Errorf("%q: expected % X, got % X", tt.input, tt.expected, c.Output())
+		}
+	}
+}
+
+func TestObjectExpressions(t *testing.T) {
+	c := New(lexer.New(`
+	.extern other
+:start
+	store #1, other + 2
+	store #2, end - 1
+	store #3, end - start
+:end
+`))
+	c.Compile()
+	obj := c.Object()
+
+	// The addends are stored in place, and the addresses of the labels
+	// added by the linker.
+	expected := []byte{0x01, 0x01, 2, 0, 0x01, 0x02, 0xFF, 0xFF, 0x01, 0x03, 12, 0}
+	if fmt.Sprint(obj.Code) != fmt.Sprint(expected) {
+		t.Errorf("expected % X, got % X", expected, obj.Code)
+	}
+	if fmt.Sprint(obj.Relocs) != "[{2 other} {6 end}]" {
+		t.Errorf("unexpected relocations %v", obj.Relocs)
+	}
+}
+
+func TestRegisterAliases(t *testing.T) {
+	c := New(lexer.New(`
+	.reg counter = #3
+	.reg total, #10
+	.scope
+	.reg counter = #4
+	add total, counter, 1
+	.endscope
+	inc counter
+	.unreg total
+	.reg total = #11
+	print_int total
+	.equ WIDTH = 7
+	store counter, WIDTH
+`))
+	c.Compile()
+
+	expected := []byte{
+		0x81, 10, 4, 1, 0,
+		0x25, 3,
+		0x02, 11,
+		0x01, 3, 7, 0,
+	}
+	if fmt.Sprint(c.Output()) != fmt.Sprint(expected) {
+		t.Errorf("expected % X, got % X", expected, c.Output())
+	}
+}
+
+func TestConditionals(t *testing.T) {
+	c := New(lexer.New(`
+	.equ LEVEL = 2
+	.ifdef DEBUG
+	.macro trace value
+	print_int value
+	.endm
+	.else
+	.macro trace value
+	.endm
+	.endif
+
+	.if LEVEL >= 2
+	trace #1
+	.ifndef VERBOSE
+	inc #2
+	.else
+	undefined_macro 1, 2
+	.endif
+	.else
+	inc #3
+	.endif
+	.if LEVEL - 2
+	inc #4
+	.endif
+`))
+	c.Define("DEBUG", 1)
+	c.Compile()
+
+	expected := []byte{
+		0x02, 1,
+		0x25, 2,
+	}
+	if fmt.Sprint(c.Output()) != fmt.Sprint(expected) {
+		t.Errorf("expected % X, got % X", expected, c.Output())
+	}
+
+	// Files aren't included by branches which aren't assembled, so
+	// needn't exist, and may be included later.
+	dir, err := ioutil.TempDir("", "compiler")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+	if err := ioutil.WriteFile(filepath.Join(dir, "inc.in"), []byte("inc #5\n"), 0644); err != nil {
+		t.Fatal(err)
+	}
+
+	main := filepath.Join(dir, "main.in")
+	c = New(lexer.NewFile(main, `
+	.ifdef DEBUG
+	.include "inc.in"
+	.include "missing.in"
+	.endif
+	.ifndef DEBUG
+	.include "inc.in"
+	.endif
+	.include "inc.in"
+`))
+	c.Compile()
+
+	expected = []byte{0x25, 5}
+	if fmt.Sprint(c.Output()) != fmt.Sprint(expected) {
+		t.Errorf("expected % X, got % X", expected, c.Output())
+	}
+}
+
+func TestLocalLabels(t *testing.T) {
+	c := New(lexer.New(`
+	.absolute
+:first
+	jmp .loop
+:.loop
+	jmp 1f
+:1
+	jmp 1b
+:second
+:.loop
+	jmp .loop
+:1
+	jmp first.loop
+	jmp 1b
+	jmp second
+`))
+	c.Compile()
+
+	expected := []byte{
+		0x10, 3, 0,
+		0x10, 6, 0,
+		0x10, 6, 0,
+		0x10, 9, 0,
+		0x10, 3, 0,
+		0x10, 12, 0,
+		0x10, 9, 0,
+	}
+	if fmt.Sprint(c.Output()) != fmt.Sprint(expected) {
+		t.Errorf("expected % X, got % X", expected, c.Output())
+	}
+	for _, name := range []string{"first.loop", "second.loop", "@1.1", "@1.2"} {
+		if _, ok := c.labels[name]; !ok {
+			t.Errorf("missing label %s", name)
+		}
+	}
+}
+
+func TestDataDirectives(t *testing.T) {
+	c := New(lexer.New(`
+	.absolute
+	jmp table
+:table
+	.word first, second, -1
+	.dword 0x12345678
+	.byte 1
+	.align 4
+	.ascii "ab", "c"
+:first
+	.asciz "d"
+	.space 2
+:second
+	.org 0x18
+	DB 0xFF
+`))
+	c.Compile()
+
+	expected := []byte{
+		0x10, 3, 0,
+		19, 0, 23, 0, 0xFF, 0xFF,
+		0x78, 0x56, 0x34, 0x12,
+		1,
+		0, 0,
+		'a', 'b', 'c',
+		'd', 0,
+		0, 0,
+		0,
+		0xFF,
+	}
+	if fmt.Sprint(c.Output()) != fmt.Sprint(expected) {
+		t.Errorf("expected % X, got % X", expected, c.Output())
+	}
+}
+
+func TestRelativeBranches(t *testing.T) {
+	c := New(lexer.New(`
+:top
+	jmp end
+	call top
+	.absolute
+	jmpz top
+	.relative
+:end
+	jmpnz top
+`))
+	c.Compile()
+
+	expected := []byte{
+		0x16, 6, 0,
+		0x75, 0xFA, 0xFF,
+		0x11, 0, 0,
+		0x18, 0xF4, 0xFF,
+	}
+	if fmt.Sprint(c.Output()) != fmt.Sprint(expected) {
+		t.Errorf("expected % X, got % X", expected, c.Output())
+	}
+}
+
+func TestStructuredFlow(t *testing.T) {
+	c := New(lexer.New(`
+	.absolute
+	.if #1 == 5
+	inc #2
+	.else
+	dec #2
+	.endif
+	.while #2 < #3
+	.break
+	.endwhile
+	.for #4 = 0 to 9
+	.continue
+	.next
+`))
+	c.Compile()
+
+	expected := []byte{
+		0x41, 1, 5, 0,
+		0x12, 12, 0,
+		0x25, 2,
+		0x10, 14, 0,
+		0x26, 2,
+
+		0x40, 2, 3,
+		0x14, 23, 0,
+		0x10, 29, 0,
+		0x10, 29, 0,
+		0x10, 14, 0,
+
+		0x01, 4, 0, 0,
+		0x41, 4, 9, 0,
+		0x15, 48, 0,
+		0x10, 43, 0,
+		0x25, 4,
+		0x10, 33, 0,
+	}
+	if fmt.Sprint(c.Output()) != fmt.Sprint(expected) {
+		t.Errorf("expected % X, got % X", expected, c.Output())
+	}
+}
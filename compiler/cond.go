@@ -0,0 +1,238 @@
+package compiler
+
+import (
+	"gosc-vm/macro"
+	"gosc-vm/token"
+)
+
+// block is a block of code opened by a directive, such as .if, and closed
+// by another, such as .endif.
+//
+// Conditional assembly only assembles one branch of an .if:
+//
+//	.ifdef DEBUG
+//	    ...
+//	.else
+//	    ...
+//	.endif
+//
+// while the blocks of structured control-flow, described in flow.go, are
+// run, and jump between the labels generated for them.
+type block struct {
+	start token.Token // the directive which opened the block
+	other bool        // set once its .else is reached
+
+	run     bool    // set for structured control-flow
+	id      int     // numbers the labels generated for it
+	counter operand // the counter of a .for loop
+	limit   operand // and its final value
+}
+
+// closer returns the directive which closes the block.
+func (b *block) closer() string {
+	switch b.start.Literal {
+	case ".while":
+		return ".endwhile"
+	case ".for":
+		return ".next"
+	}
+	return ".endif"
+}
+
+// innermost returns the innermost block, ensuring that it was opened by
+// the given directive, or else one which is closed by the same one.
+func (p *Compiler) innermost(dir token.Token, opener string, closer string) *block {
+	if len(p.blocks) == 0 {
+		p.fail(dir, "%s without %s", dir.Literal, opener)
+	}
+	b := &p.blocks[len(p.blocks)-1]
+	if b.closer() != closer {
+		p.fail(dir, "Expected %s for the %s at %s, got %s", b.closer(), b.start.Literal, b.start.Location(), dir.Literal)
+	}
+	return b
+}
+
+// condOp handles the directives of conditional assembly.
+//
+// The condition of an .if is an expression of constants, which holds if
+// it's non-zero, or a comparison of two, such as "LEVEL >= 2", while
+// .ifdef and .ifndef test whether a constant is defined.  The branch not
+// taken is skipped without expanding it, so the two may define a macro
+// differently.
+//
+// An .if which tests a register is structured control-flow instead.
+func (p *Compiler) condOp() {
+	dir := p.curToken
+	switch dir.Literal {
+	case ".if", ".ifdef", ".ifndef":
+		// the line after this one may not be assembled, so
+		// mustn't be included while looking for its end
+		p.files.SetRaw(true)
+		line := p.l.Rest(dir)
+		p.files.SetRaw(false)
+		if dir.Literal == ".if" && len(line) > 0 && line[0].Type == token.IDENT && p.isRegister(line[0].Literal) {
+			p.flowOp(line)
+			return
+		}
+		p.blocks = append(p.blocks, block{start: dir})
+		if !p.condition(dir, line) {
+			p.skip()
+		}
+
+	case ".else":
+		if p.innermost(dir, ".if", ".endif").run {
+			p.flowOp(nil)
+			return
+		}
+		// the branch before it was assembled, so this one isn't
+		p.otherBranch()
+		p.skip()
+
+	case ".endif":
+		if p.innermost(dir, ".if", ".endif").run {
+			p.flowOp(nil)
+			return
+		}
+		p.endBlock()
+	}
+}
+
+// otherBranch handles the .else of the innermost block.
+func (p *Compiler) otherBranch() {
+	b := p.innermost(p.curToken, ".if", ".endif")
+	if b.other {
+		p.fail(p.curToken, "Duplicate .else for the .if at %s", b.start.Location())
+	}
+	b.other = true
+}
+
+// endBlock handles the .endif of the innermost block.
+func (p *Compiler) endBlock() {
+	p.innermost(p.curToken, ".if", ".endif")
+	p.blocks = p.blocks[:len(p.blocks)-1]
+}
+
+// skip skips a branch which isn't assembled, up to the .else or .endif
+// which ends it, leaving that as the current token.
+func (p *Compiler) skip() {
+	p.files.SetRaw(true)
+	defer p.files.SetRaw(false)
+
+	depth := 0
+	for {
+		tok := p.l.NextRaw()
+		if tok.Type == token.EOF {
+			p.fail(p.blocks[len(p.blocks)-1].start, "Missing .endif")
+		}
+		if tok.Type != token.DIRECTIVE {
+			continue
+		}
+		switch tok.Literal {
+		case ".if", ".ifdef", ".ifndef":
+			depth++
+		case ".else":
+			if depth == 0 {
+				p.curToken = tok
+				p.otherBranch()
+				return
+			}
+		case ".endif":
+			if depth == 0 {
+				p.curToken = tok
+				p.endBlock()
+				return
+			}
+			depth--
+		}
+	}
+}
+
+// condition returns true if the condition of an .if, .ifdef or .ifndef
+// holds, given the rest of its line.
+func (p *Compiler) condition(dir token.Token, line []token.Token) bool {
+	if len(line) == 0 {
+		p.fail(dir, "Missing condition for %s", dir.Literal)
+	}
+
+	if dir.Literal != ".if" {
+		name := line[0]
+		if len(line) != 1 || (name.Type != token.IDENT && name.Type != token.INSTRUCTION) {
+			p.fail(name, "Expected the name of a constant, got '%s'", name.Literal)
+		}
+		_, ok := p.constants[name.Literal]
+		return ok == (dir.Literal == ".ifdef")
+	}
+
+	var left, right int
+	var op token.Token
+	p.parseLine(dir, line, func() {
+		left = p.constant(p.expression())
+		if p.peekTokenIs(token.EOF) {
+			return
+		}
+		p.nextToken()
+		op = p.curToken
+		p.nextToken()
+		right = p.constant(p.expression())
+	})
+
+	switch op.Type {
+	case "":
+		return left != 0
+	case token.EQ:
+		return left == right
+	case token.NOT_EQ:
+		return left != right
+	case token.LT:
+		return left < right
+	case token.GT:
+		return left > right
+	case token.LT_EQ:
+		return left <= right
+	case token.GT_EQ:
+		return left >= right
+	}
+	p.fail(op, "Expected a comparison, got '%s'", op.Literal)
+	return false
+}
+
+// parseLine runs the given parser over the rest of the line of the given
+// directive, so that it can't run on to the next line, and ensures the
+// whole line is parsed.
+func (p *Compiler) parseLine(dir token.Token, line []token.Token, parse func()) {
+	saved := p.l
+	p.l = macro.New(&tokenList{tokens: line, eof: token.Token{Type: token.EOF, File: dir.File, Line: dir.Line, Expansion: dir.Expansion}})
+	p.nextToken()
+	parse()
+	if !p.peekTokenIs(token.EOF) {
+		p.nextToken()
+		p.fail(p.curToken, "Unexpected '%s' after %s", p.curToken.Literal, dir.Literal)
+	}
+	p.l = saved
+	p.peeked = false
+}
+
+// constant returns the value of an expression which must be known now.
+func (p *Compiler) constant(e *expr) int {
+	val := p.eval(e, false)
+	if len(val.syms) > 0 {
+		p.fail(e.tok, "Expected a constant, got '%s'", e)
+	}
+	return val.n
+}
+
+// tokenList is a source of the given tokens, and then of eof.
+type tokenList struct {
+	tokens []token.Token
+	eof    token.Token
+}
+
+// NextToken returns the next of our tokens.
+func (l *tokenList) NextToken() token.Token {
+	if len(l.tokens) == 0 {
+		return l.eof
+	}
+	tok := l.tokens[0]
+	l.tokens = l.tokens[1:]
+	return tok
+}
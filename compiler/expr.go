@@ -0,0 +1,275 @@
+package compiler
+
+import (
+	"fmt"
+	"strconv"
+
+	"gosc-vm/token"
+)
+
+// expr is an integer expression, such as "BUFFER + 16", built from
+// literals, and the names of labels and constants.
+//
+// Expressions are evaluated once every label is known, so they may refer
+// to labels defined later.
+type expr struct {
+	tok   token.Token // a literal or name, or else the operator
+	left  *expr       // the operands of an operator, of which unary
+	right *expr       // minus has only the right
+}
+
+// String returns the expression in a readable form, for diagnostics.
+func (e *expr) String() string {
+	switch {
+	case e.right == nil:
+		return e.tok.Literal
+	case e.left == nil:
+		return "-" + e.right.operand()
+	}
+	return e.left.operand() + " " + e.tok.Literal + " " + e.right.operand()
+}
+
+// operand returns the expression as the operand of another, bracketed
+// unless it's a literal or name.
+func (e *expr) operand() string {
+	if e.right == nil {
+		return e.String()
+	}
+	return "(" + e.String() + ")"
+}
+
+// fixup is a value in our bytecode which is to be patched with that of
+// an expression.
+type fixup struct {
+	expr     *expr
+	size     int  // in bytes
+	min      int  // the smallest value allowed, which may be negative
+	relative bool // set if the value is an offset from the end of the fixup
+}
+
+// linear is the value of an expression, as a constant plus multiples of
+// the addresses of labels which aren't known.
+//
+// Our own labels are known relative to the start of our code, whose
+// address is the symbol "", with local naming one of them, and those of
+// the data section relative to its start, dataBase.
+type linear struct {
+	n     int
+	syms  map[string]int
+	local string
+}
+
+// dataBase stands for the address of the data section, in the symbols
+// of a linear value.
+const dataBase = "@data"
+
+// add returns the sum of two values, multiplying the second by scale.
+func (v linear) add(o linear, scale int) linear {
+	out := linear{n: v.n + scale*o.n, syms: make(map[string]int), local: v.local}
+	if out.local == "" {
+		out.local = o.local
+	}
+	for name, k := range v.syms {
+		out.syms[name] = k
+	}
+	for name, k := range o.syms {
+		out.syms[name] += scale * k
+		if out.syms[name] == 0 {
+			// as in "end - start", where the two cancel out
+			delete(out.syms, name)
+		}
+	}
+	return out
+}
+
+// expression parses an expression, starting at the current token, and
+// leaves the last token of it as the current one.
+func (p *Compiler) expression() *expr {
+	e := p.term()
+	for p.peekTokenIs(token.PLUS) || p.peekTokenIs(token.MINUS) {
+		p.nextToken()
+		op := p.curToken
+		p.nextToken()
+		e = &expr{tok: op, left: e, right: p.term()}
+	}
+	return e
+}
+
+// term parses a product, or quotient.
+func (p *Compiler) term() *expr {
+	e := p.unary()
+	for p.peekTokenIs(token.ASTERISK) || p.peekTokenIs(token.SLASH) {
+		p.nextToken()
+		op := p.curToken
+		p.nextToken()
+		e = &expr{tok: op, left: e, right: p.unary()}
+	}
+	return e
+}
+
+// unary parses a literal, name, negation, or bracketed expression.
+func (p *Compiler) unary() *expr {
+	switch p.curToken.Type {
+	case token.MINUS:
+		op := p.curToken
+		p.nextToken()
+		return &expr{tok: op, right: p.unary()}
+	case token.LPAREN:
+		p.nextToken()
+		e := p.expression()
+		p.nextToken()
+		if !p.curTokenIs(token.RPAREN) {
+			p.fail(p.curToken, "Expected ')', got '%s'", p.curToken.Literal)
+		}
+		return e
+	case token.INT:
+		return &expr{tok: p.curToken}
+	case token.IDENT, token.INSTRUCTION:
+		if !p.isRegister(p.curToken.Literal) {
+			tok := p.curToken
+			tok.Literal = p.labelName(tok)
+			p.used[tok.Literal] = true
+			return &expr{tok: tok}
+		}
+	}
+	p.fail(p.curToken, "Expected an integer, or name, got '%s'", p.curToken.Literal)
+	return nil
+}
+
+// eval returns the value of an expression.
+//
+// The addresses of labels from other objects are unknown, so are left
+// as symbols, as are those of our own labels if symbolic is set.
+func (p *Compiler) eval(e *expr, symbolic bool) linear {
+	switch {
+	case e.tok.Type == token.INT:
+		val, err := strconv.ParseInt(e.tok.Literal, 0, 64)
+		if err != nil {
+			p.fail(e.tok, "Invalid integer: %s", e.tok.Literal)
+		}
+		return linear{n: int(val)}
+
+	case e.right == nil:
+		return p.name(e.tok, symbolic)
+
+	case e.left == nil:
+		return linear{}.add(p.eval(e.right, symbolic), -1)
+	}
+
+	a := p.eval(e.left, symbolic)
+	b := p.eval(e.right, symbolic)
+	switch e.tok.Type {
+	case token.PLUS:
+		return a.add(b, 1)
+	case token.MINUS:
+		return a.add(b, -1)
+	case token.ASTERISK:
+		if len(a.syms) == 0 {
+			return linear{}.add(b, a.n)
+		}
+		if len(b.syms) == 0 {
+			return linear{}.add(a, b.n)
+		}
+		p.fail(e.tok, "Cannot multiply addresses which aren't yet known: %s", e)
+	case token.SLASH:
+		if len(a.syms) > 0 || len(b.syms) > 0 {
+			p.fail(e.tok, "Cannot divide addresses which aren't yet known: %s", e)
+		}
+		if b.n == 0 {
+			p.fail(e.tok, "Division by zero: %s", e)
+		}
+		return linear{n: a.n / b.n}
+	}
+	return linear{}
+}
+
+// name returns the value of a label, or constant.
+func (p *Compiler) name(tok token.Token, symbolic bool) linear {
+	name := tok.Literal
+
+	if c, ok := p.constants[name]; ok {
+		if p.evaluating[name] {
+			p.fail(tok, "Constant '%s' is defined in terms of itself", name)
+		}
+		p.evaluating[name] = true
+		defer delete(p.evaluating, name)
+		return p.eval(c, symbolic)
+	}
+
+	addr, ok := p.labels[name]
+	if ok && p.dataLabels[name] {
+		return linear{n: addr, syms: map[string]int{dataBase: 1}}
+	}
+	if ok && !symbolic {
+		return linear{n: addr}
+	}
+	if ok {
+		return linear{n: addr, syms: map[string]int{"": 1}, local: name}
+	}
+	if p.externs[name] {
+		return linear{syms: map[string]int{name: 1}}
+	}
+	p.fail(tok, "Use of undefined label '%s'", name)
+	return linear{}
+}
+
+// value outputs the value of an expression, of the given size in bytes,
+// patching it in later unless it's a literal.
+func (p *Compiler) value(e *expr, size int, min int) {
+	p.output(&fixup{expr: e, size: size, min: min})
+}
+
+// relative outputs the target of a jump, or call, as a two-byte offset
+// from the end of the instruction, i.e. that of the offset itself.
+func (p *Compiler) relative(e *expr) {
+	p.output(&fixup{expr: e, size: 2, min: -0x8000, relative: true})
+}
+
+// output reserves space for a fixup, patching it now if its expression
+// is a literal.
+func (p *Compiler) output(f *fixup) {
+	addr := len(p.bytecode)
+	p.bytecode = append(p.bytecode, make([]byte, f.size)...)
+
+	if f.expr.tok.Type == token.INT {
+		p.patch(p.bytecode, addr, f, p.eval(f.expr, false).n)
+		return
+	}
+	p.fixups[addr] = f
+}
+
+// external returns true if an expression uses labels from other objects,
+// as far as we know.
+func (p *Compiler) external(e *expr) bool {
+	if e == nil {
+		return false
+	}
+	if e.right == nil {
+		return p.externs[e.tok.Literal]
+	}
+	return p.external(e.left) || p.external(e.right)
+}
+
+// patch stores a value in the given code, checking that it fits.  The
+// value of a relative fixup is the address it refers to.
+func (p *Compiler) patch(code []byte, addr int, f *fixup, val int) {
+	max := 1<<(8*f.size) - 1
+	if f.relative {
+		val -= addr + f.size
+		max = 1<<(8*f.size-1) - 1
+	}
+	if val < f.min || val > max {
+		p.fail(f.expr.tok, "Integer out of range %d-%d: %s", f.min, max, describe(f.expr, val))
+	}
+	for i := 0; i < f.size; i++ {
+		code[addr+i] = byte(val >> (8 * i))
+	}
+}
+
+// describe returns an expression, with its value if that isn't obvious.
+func describe(e *expr, val int) string {
+	if e.tok.Type == token.INT {
+		return e.String()
+	}
+	return fmt.Sprintf("%s (%d)", e, val)
+}
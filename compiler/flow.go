@@ -0,0 +1,240 @@
+package compiler
+
+import (
+	"fmt"
+	"strings"
+
+	"gosc-vm/token"
+)
+
+// Structured control-flow saves writing the comparisons, jumps and labels
+// of conditionals and loops by hand:
+//
+//	.if #1 == 5
+//	    ...
+//	.else
+//	    ...
+//	.endif
+//
+//	.while #2 < #3
+//	    ...
+//	.endwhile
+//
+//	.for #4 = 0 to 10
+//	    ...
+//	.next
+//
+// A condition compares a register with a register, string or integer
+// expression, or else holds if the register is non-zero.  A .for loop
+// runs with each value of its counter from the first to the limit, which
+// may be a register, inclusive.  Within a loop, .break jumps past its end,
+// and .continue on to the next iteration.
+//
+// Each block generates labels such as "@while2.top", which no name we
+// can write may refer to.
+
+// branch holds how a comparison is tested: either by the one jump which
+// skips the block if it fails, or else by those which enter it if it
+// holds.
+type branch struct {
+	fails string
+	holds []string
+}
+
+// branches holds the branch for each comparison.  As the flags are all
+// clear when the values can't be compared, only equality can be tested
+// by its opposite.
+var branches = map[token.TokenType]branch{
+	token.EQ:     {fails: "jmpnz"},
+	token.NOT_EQ: {fails: "jmpz"},
+	token.LT:     {holds: []string{"jmplt"}},
+	token.GT:     {holds: []string{"jmpgt"}},
+	token.LT_EQ:  {holds: []string{"jmplt", "jmpz"}},
+	token.GT_EQ:  {holds: []string{"jmpgt", "jmpz"}},
+}
+
+// comparison is the condition of an .if or .while.
+type comparison struct {
+	left  operand
+	op    token.Token
+	right operand
+}
+
+// flowOp handles the directives of structured control-flow, given the
+// rest of the line.
+func (p *Compiler) flowOp(line []token.Token) {
+	dir := p.curToken
+	switch dir.Literal {
+	case ".if":
+		b := p.open(block{start: dir})
+		p.unless(dir, p.comparison(dir, line), b.label("then"), b.label("else"))
+
+	case ".else":
+		b := p.innermost(dir, ".if", ".endif")
+		if b.other {
+			p.fail(dir, "Duplicate .else for the .if at %s", b.start.Location())
+		}
+		b.other = true
+		p.assemble(dir, "jmp", p.jump(dir, b.label("end")))
+		p.here(b.label("else"))
+
+	case ".endif":
+		b := p.innermost(dir, ".if", ".endif")
+		if !b.other {
+			p.here(b.label("else"))
+		}
+		p.here(b.label("end"))
+		p.blocks = p.blocks[:len(p.blocks)-1]
+
+	case ".while":
+		b := p.open(block{start: dir})
+		p.here(b.label("top"))
+		p.unless(dir, p.comparison(dir, line), b.label("do"), b.label("end"))
+
+	case ".endwhile":
+		b := p.innermost(dir, ".while", ".endwhile")
+		p.assemble(dir, "jmp", p.jump(dir, b.label("top")))
+		p.here(b.label("end"))
+		p.blocks = p.blocks[:len(p.blocks)-1]
+
+	case ".for":
+		var first operand
+		b := block{start: dir}
+		p.parseLine(dir, line, func() {
+			b.counter = p.register(dir)
+			p.nextToken()
+			if !p.curTokenIs(token.ASSIGN) {
+				p.fail(p.curToken, "Expected '=' after the counter of .for, got '%s'", p.curToken.Literal)
+			}
+			p.nextToken()
+			first = p.operand()
+			p.nextToken()
+			if p.curToken.Literal != "to" {
+				p.fail(p.curToken, "Expected 'to' after the first value of .for, got '%s'", p.curToken.Literal)
+			}
+			p.nextToken()
+			b.limit = p.operand()
+		})
+
+		p.assemble(dir, "store", b.counter, first)
+		loop := p.open(b)
+		p.here(loop.label("top"))
+		p.assemble(dir, "cmp", loop.counter, loop.limit)
+		p.assemble(dir, "jmpgt", p.jump(dir, loop.label("end")))
+
+	case ".next":
+		b := p.innermost(dir, ".for", ".next")
+		if len(line) > 0 && (len(line) > 1 || line[0].Literal != b.counter.tok.Literal) {
+			p.fail(line[0], "Expected .next %s, for the .for at %s", b.counter.tok.Literal, b.start.Location())
+		}
+		p.here(b.label("next"))
+		p.assemble(dir, "inc", b.counter)
+		p.assemble(dir, "jmp", p.jump(dir, b.label("top")))
+		p.here(b.label("end"))
+		p.blocks = p.blocks[:len(p.blocks)-1]
+
+	case ".break", ".continue":
+		b := p.loop(dir)
+		target := b.label("end")
+		if dir.Literal == ".continue" {
+			target = b.label("top")
+			if b.start.Literal == ".for" {
+				target = b.label("next")
+			}
+		}
+		p.assemble(dir, "jmp", p.jump(dir, target))
+	}
+}
+
+// open opens a structured block, numbering it, and returns it.
+func (p *Compiler) open(b block) *block {
+	p.flows++
+	b.run = true
+	b.id = p.flows
+	p.blocks = append(p.blocks, b)
+	return &p.blocks[len(p.blocks)-1]
+}
+
+// loop returns the innermost loop, for .break or .continue.
+func (p *Compiler) loop(dir token.Token) *block {
+	for i := len(p.blocks) - 1; i >= 0; i-- {
+		if p.blocks[i].closer() != ".endif" {
+			return &p.blocks[i]
+		}
+	}
+	p.fail(dir, "%s outside of a loop", dir.Literal)
+	return nil
+}
+
+// label returns the name of one of the labels generated for the block.
+func (b *block) label(part string) string {
+	return fmt.Sprintf("@%s%d.%s", strings.TrimPrefix(b.start.Literal, "."), b.id, part)
+}
+
+// here defines a generated label at the current point in our bytecode.
+func (p *Compiler) here(name string) {
+	p.labels[name] = len(p.bytecode)
+}
+
+// jump returns an operand which refers to the given label.
+func (p *Compiler) jump(at token.Token, name string) operand {
+	tok := at
+	tok.Type = token.IDENT
+	tok.Literal = name
+	return operand{tok: tok, expr: &expr{tok: tok}}
+}
+
+// register reads an operand which must be a register.
+func (p *Compiler) register(dir token.Token) operand {
+	op := p.operand()
+	if op.expr != nil || op.tok.Type != token.IDENT {
+		p.fail(op.tok, "Expected a register for %s, got '%s'", dir.Literal, op)
+	}
+	return op
+}
+
+// comparison parses the condition of an .if or .while, given the rest of
+// its line.
+func (p *Compiler) comparison(dir token.Token, line []token.Token) comparison {
+	if len(line) == 0 {
+		p.fail(dir, "Missing condition for %s", dir.Literal)
+	}
+
+	var c comparison
+	p.parseLine(dir, line, func() {
+		c.left = p.register(dir)
+		if p.peekTokenIs(token.EOF) {
+			// a register holds if it's non-zero
+			zero := token.Token{Type: token.INT, Literal: "0", File: dir.File, Line: dir.Line}
+			c.op = token.Token{Type: token.NOT_EQ, Literal: "!="}
+			c.right = operand{tok: zero, expr: &expr{tok: zero}}
+			return
+		}
+		p.nextToken()
+		c.op = p.curToken
+		if _, ok := branches[c.op.Type]; !ok {
+			p.fail(c.op, "Expected a comparison, got '%s'", c.op.Literal)
+		}
+		p.nextToken()
+		c.right = p.operand()
+	})
+	return c
+}
+
+// unless outputs the test of a comparison, which jumps to the label
+// target if it fails, and otherwise continues with the code which
+// follows, at the label body.
+func (p *Compiler) unless(at token.Token, c comparison, body string, target string) {
+	p.assemble(at, "cmp", c.left, c.right)
+
+	b := branches[c.op.Type]
+	if b.fails != "" {
+		p.assemble(at, b.fails, p.jump(at, target))
+		return
+	}
+	for _, mnemonic := range b.holds {
+		p.assemble(at, mnemonic, p.jump(at, body))
+	}
+	p.assemble(at, "jmp", p.jump(at, target))
+	p.here(body)
+}
@@ -0,0 +1,138 @@
+package compiler
+
+import (
+	"fmt"
+	"sort"
+	"strings"
+
+	"gosc-vm/token"
+)
+
+// label defines a label at the current point in our bytecode.
+//
+// A label whose name starts with "." is local to the global label before
+// it, so ".loop" following "strlen" is named "strlen.loop", and another
+// routine may have its own.  Numeric labels, such as "1", may be defined
+// any number of times, and are referred to as "1b" or "1f", meaning the
+// nearest one before, or after, the reference.
+func (p *Compiler) label(tok token.Token) {
+	name := strings.TrimPrefix(tok.Literal, ":")
+	switch {
+	case name != "" && strings.Trim(name, "0123456789") == "":
+		p.numeric[name]++
+		name = numericLabel(name, p.numeric[name])
+	case strings.HasPrefix(name, "."):
+		if token.LookupIdentifier(name) == token.DIRECTIVE {
+			// references to it would be read as the directive
+			p.fail(tok, "Local label '%s' has the name of a directive", name)
+		}
+		name = p.scope + name
+	case !strings.Contains(name, "@"):
+		// those of macros are unique to each expansion, so
+		// don't start a scope
+		name = p.libraryName(name)
+		p.scope = name
+	}
+
+	if prev, ok := p.defs[name]; ok {
+		p.fail(tok, "Label '%s' is already defined at %s", name, prev.Location())
+	}
+	if _, ok := p.constants[name]; ok {
+		p.fail(tok, "Label '%s' is already defined as a constant", name)
+	}
+	if p.library {
+		// the routines of the standard library needn't all be used
+		p.used[name] = true
+	}
+
+	// The label points to the current point in our bytecode
+	p.labels[name] = len(p.bytecode)
+	p.defs[name] = tok
+	if p.inData {
+		p.dataLabels[name] = true
+	}
+}
+
+// labelName returns the name of the label, or constant, a reference
+// refers to.
+func (p *Compiler) labelName(tok token.Token) string {
+	name := tok.Literal
+	if strings.HasPrefix(name, ".") {
+		return p.scope + name
+	}
+	if len(name) < 2 || strings.Trim(name[:len(name)-1], "0123456789") != "" {
+		return p.libraryName(name)
+	}
+
+	n := name[:len(name)-1]
+	switch name[len(name)-1] {
+	case 'b':
+		if p.numeric[n] == 0 {
+			p.fail(tok, "No label :%s precedes %s", n, name)
+		}
+		return numericLabel(n, p.numeric[n])
+	case 'f':
+		label := numericLabel(n, p.numeric[n]+1)
+		p.forward[label] = tok
+		return label
+	}
+	return p.libraryName(name)
+}
+
+// libraryPrefix starts the name of each label of the standard library.
+const libraryPrefix = "@std."
+
+// libraryName returns the name a label is known by, which for those of
+// the standard library has the prefix "@std.", so that they don't clash
+// with those of the program using it.  Once a module is compiled, those
+// it exports are also known by their own names, unless the program has
+// a label of the same name.
+func (p *Compiler) libraryName(name string) string {
+	if !p.library || strings.Contains(name, "@") {
+		return name
+	}
+	if _, ok := p.constants[name]; ok {
+		return name
+	}
+	return libraryPrefix + name
+}
+
+// numericLabel returns the name we give to the given definition of a
+// numeric label, such as "@1.3" for the third ":1".
+func numericLabel(n string, count int) string {
+	return fmt.Sprintf("@%s.%d", n, count)
+}
+
+// warnUnused warns of the labels of our program which are never used, other
+// than those which are exported, or name the entry point.
+func (p *Compiler) warnUnused() {
+	exported := map[string]bool{p.entry: true}
+	for _, name := range p.globals {
+		exported[name] = true
+	}
+
+	var unused []string
+	for name := range p.defs {
+		if p.entry == "" && p.labels[name] == 0 && !p.dataLabels[name] {
+			// execution starts at the first instruction
+			continue
+		}
+		if !p.used[name] && !exported[name] {
+			unused = append(unused, name)
+		}
+	}
+	sort.Slice(unused, func(i, j int) bool {
+		if p.labels[unused[i]] != p.labels[unused[j]] {
+			return p.labels[unused[i]] < p.labels[unused[j]]
+		}
+		return unused[i] < unused[j]
+	})
+	for _, name := range unused {
+		def := p.defs[name]
+		if strings.HasPrefix(name, "@") && strings.Trim(def.Literal, ":0123456789") == "" {
+			// a numeric label, which we know as "@1.2"
+			name = def.Literal
+		}
+		fmt.Printf("WARNING: %s: Label '%s' is never used\n", def.Location(), name)
+	}
+}
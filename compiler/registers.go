@@ -0,0 +1,123 @@
+package compiler
+
+import (
+	"fmt"
+	"sort"
+	"strconv"
+	"strings"
+
+	"gosc-vm/opcode"
+	"gosc-vm/token"
+)
+
+// scope holds the register aliases defined within a block.
+type scope struct {
+	start   token.Token     // the directive which opened the block
+	aliases map[string]byte // the aliases defined within it
+}
+
+// alias returns the register a live alias names.
+func (p *Compiler) alias(name string) (byte, bool) {
+	for i := len(p.scopes) - 1; i >= 0; i-- {
+		if reg, ok := p.scopes[i].aliases[name]; ok {
+			return reg, true
+		}
+	}
+	return 0, false
+}
+
+// regOp handles the directives which define register aliases, and the
+// blocks they're scoped to:
+//
+//	.reg counter = #3
+//	.unreg counter
+//	.scope
+//	.endscope
+func (p *Compiler) regOp() {
+	dir := p.curToken
+	switch dir.Literal {
+	case ".scope":
+		p.scopes = append(p.scopes, scope{start: dir, aliases: make(map[string]byte)})
+
+	case ".endscope":
+		if len(p.scopes) == 1 {
+			p.fail(dir, ".endscope without .scope")
+		}
+		p.scopes = p.scopes[:len(p.scopes)-1]
+
+	case ".unreg":
+		p.nextToken()
+		name := p.curToken.Literal
+		if _, ok := p.scopes[len(p.scopes)-1].aliases[name]; !ok {
+			p.fail(p.curToken, "'%s' isn't a register alias of this scope", name)
+		}
+		delete(p.scopes[len(p.scopes)-1].aliases, name)
+
+	case ".reg":
+		p.nextToken()
+		name := p.curToken
+		if name.Type != token.IDENT || strings.HasPrefix(name.Literal, "#") {
+			p.fail(name, "Expected the name of a register alias, got '%s'", name.Literal)
+		}
+		if p.peekTokenIs(token.ASSIGN) || p.peekTokenIs(token.COMMA) {
+			p.nextToken()
+		}
+		p.nextToken()
+		if p.curToken.Type != token.IDENT || !p.isRegister(p.curToken.Literal) {
+			p.fail(p.curToken, "Expected a register for '%s', got '%s'", name.Literal, p.curToken.Literal)
+		}
+		reg := p.getRegister(p.curToken)
+
+		aliases := p.scopes[len(p.scopes)-1].aliases
+		if _, ok := aliases[name.Literal]; ok {
+			p.fail(name, "Register alias '%s' is already defined in this scope", name.Literal)
+		}
+		for _, other := range p.live() {
+			if r, _ := p.alias(other); r == reg {
+				fmt.Printf("WARNING: %s: '%s' and '%s' are both #%d\n", name.Location(), name.Literal, other, reg)
+			}
+		}
+		aliases[name.Literal] = reg
+	}
+}
+
+// live returns the names of the aliases which may be used, sorted.
+func (p *Compiler) live() []string {
+	var names []string
+	seen := make(map[string]bool)
+	for i := len(p.scopes) - 1; i >= 0; i-- {
+		for name := range p.scopes[i].aliases {
+			if !seen[name] {
+				seen[name] = true
+				names = append(names, name)
+			}
+		}
+	}
+	sort.Strings(names)
+	return names
+}
+
+// isRegister returns true if the given string is a register, such as
+// "#2", or a live alias of one.
+func (p *Compiler) isRegister(input string) bool {
+	if strings.HasPrefix(input, "#") {
+		return true
+	}
+	_, ok := p.alias(input)
+	return ok
+}
+
+// getRegister converts a register token "#2", or an alias of one, to an
+// integer 2.
+func (p *Compiler) getRegister(tok token.Token) byte {
+	if reg, ok := p.alias(tok.Literal); ok {
+		return reg
+	}
+
+	num := strings.TrimPrefix(tok.Literal, "#")
+	i, err := strconv.Atoi(num)
+	if err != nil || i < 0 || i >= opcode.Registers {
+		p.fail(tok, "Invalid register %s, expected #0 to #%d", tok.Literal, opcode.Registers-1)
+	}
+	return byte(i)
+}
@@ -0,0 +1,117 @@
+package cpu
+
+import (
+	"fmt"
+	"os"
+
+	"gosc-vm/opcode"
+)
+
+// aluBinary executes a binary integer operation.
+//
+// The operands are a destination register, a source register, and then
+// either a second source register or, for the immediate forms, a 16-bit
+// value.  The result is stored, and the flags updated from it.
+func (c *CPU) aluBinary(d opcode.Decoded, op func(a int, b int) int) {
+	reg := byte(d.Args[0].Int)
+	a := d.Args[1].Int
+
+	// second operand
+	bVal := d.Args[2].Int
+	if d.Operands[2] == opcode.Reg {
+		bVal = c.register(bVal).GetInt()
+	}
+
+	c.setResult(reg, op(c.register(a).GetInt(), bVal))
+}
+
+// aluUnary executes a unary integer operation, with a destination and a
+// source register.
+func (c *CPU) aluUnary(d opcode.Decoded, op func(a int) int) {
+	reg := byte(d.Args[0].Int)
+	a := d.Args[1].Int
+
+	c.setResult(reg, op(c.register(a).GetInt()))
+}
+
+// setResult stores the result of an integer operation, and sets the
+// flags to show whether it was zero, negative, or positive.
+func (c *CPU) setResult(reg byte, val int) {
+	c.register(int(reg)).SetInt(val)
+	c.flags.setOrder(compareInt(val, 0))
+}
+
+//
+// The operations themselves.
+//
+
+func opXor(a int, b int) int { return a ^ b }
+func opAdd(a int, b int) int { return a + b }
+func opSub(a int, b int) int { return a - b }
+func opMul(a int, b int) int { return a * b }
+func opAnd(a int, b int) int { return a & b }
+func opOr(a int, b int) int  { return a | b }
+
+func opDiv(a int, b int) int {
+	if b == 0 {
+		fmt.Printf("Attempting to divide by zero - denying\n")
+		os.Exit(3)
+	}
+	return a / b
+}
+
+func opMod(a int, b int) int {
+	if b == 0 {
+		fmt.Printf("Attempting to divide by zero - denying\n")
+		os.Exit(3)
+	}
+	return a % b
+}
+
+// opShl shifts left.
+func opShl(a int, b int) int {
+	return a << shiftCount(b)
+}
+
+// opShr shifts right, filling with zeros.
+func opShr(a int, b int) int {
+	return int(uint(a) >> shiftCount(b))
+}
+
+// opSar shifts right, preserving the sign.
+func opSar(a int, b int) int {
+	return a >> shiftCount(b)
+}
+
+func opMin(a int, b int) int {
+	if a < b {
+		return a
+	}
+	return b
+}
+
+func opMax(a int, b int) int {
+	if a > b {
+		return a
+	}
+	return b
+}
+
+func opNot(a int) int { return ^a }
+func opNeg(a int) int { return -a }
+
+func opAbs(a int) int {
+	if a < 0 {
+		return -a
+	}
+	return a
+}
+
+// shiftCount validates the number of places to shift by.
+func shiftCount(b int) uint {
+	if b < 0 {
+		fmt.Printf("Attempting to shift by a negative amount - denying\n")
+		os.Exit(3)
+	}
+	return uint(b)
+}
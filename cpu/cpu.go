@@ -14,20 +14,32 @@ package cpu
 
 import (
 	"bytes"
+	"encoding/binary"
 	"fmt"
 	"io/ioutil"
+	"math"
+	"math/big"
 	"math/rand"
 	"os"
 	"os/exec"
 	"regexp"
+	"sort"
 	"strconv"
+	"strings"
 	"time"
+
+	"gosc-vm/binfmt"
+	"gosc-vm/opcode"
 )
 
-// Flags holds the CPU flags - of which we only have one.
+// Flags holds the CPU flags.
 type Flags struct {
 	// Zero-flag
 	z bool
+	// Less-than flag, set by comparisons
+	lt bool
+	// Greater-than flag, set by comparisons
+	gt bool
 }
 
 // Register holds the contents of a single register.
@@ -37,29 +49,64 @@ type Register struct {
 	i int
 	// String contents of register if t == "string"
 	s string
-	// Register type: "int" vs. "string"
+	// Floating-point contents of register if t == "float"
+	f float64
+	// Arbitrary-precision contents of register if t == "big"
+	b *big.Int
+	// Register type: "int" vs. "string" vs. "float" vs. "big"
 	t string
 }
 
+// RegisterFault is the error raised when an instruction names a register
+// which doesn't exist.
+type RegisterFault struct {
+	// Reg is the number of the register named.
+	Reg int
+	// IP is the address of the instruction.
+	IP int
+}
+
+// Error implements the error interface.
+func (f *RegisterFault) Error() string {
+	return fmt.Sprintf("register fault: invalid register #%d at IP %04X", f.Reg, f.IP)
+}
+
 // Stack holds return-addresses when the `call` operation is being completed.
 // It can also be used for storing ints.
+//
+// The entries live in the stack segment at the top of RAM, each taking
+// eight bytes, and the stack grows downwards.
 type Stack struct {
-	// The entries on our stack
-	entries []int
+	// The CPU whose RAM holds our entries
+	cpu *CPU
+	// The address of the most recently pushed entry
+	sp int
 }
 
 // CPU is our virtual machine state.
 type CPU struct {
 	// Registers
-	regs [16]Register
+	regs [opcode.Registers]Register
 	// Flags
 	flags Flags
 	// Our RAM - where the program is loaded
-	mem [0xFFFF]byte
+	mem [memSize]byte
+	// The memory layout, and permissions, of our RAM
+	segments []Segment
+	// The programs loaded into RAM, in address order
+	modules []module
 	// Instruction-pointer
 	ip int
+	// Address of the instruction currently being executed
+	opIP int
 	// stack
 	stack *Stack
+	// heap, managing the data segment
+	heap *Heap
+	// Is the heap in debug mode?
+	heapDebug bool
+	// How `print_int` shows integers
+	printMode PrintMode
 }
 
 //
@@ -108,6 +155,49 @@ func trimQuotes(in string, c byte) string {
 	return in
 }
 
+//
+// Flag functions
+//
+
+// setOrder updates the flags from the result of a comparison, which is
+// negative, zero, or positive as the left-hand side is less than, equal
+// to, or greater than the right-hand side.
+func (f *Flags) setOrder(result int) {
+	f.z = result == 0
+	f.lt = result < 0
+	f.gt = result > 0
+}
+
+// unordered clears the flags after a comparison of values which cannot be
+// compared, such as an integer with a string.
+func (f *Flags) unordered() {
+	f.z = false
+	f.lt = false
+	f.gt = false
+}
+
+// compareInt returns the ordering of two integers.
+func compareInt(a int, b int) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
+// compareFloat returns the ordering of two floating-point numbers.
+func compareFloat(a float64, b float64) int {
+	switch {
+	case a < b:
+		return -1
+	case a > b:
+		return 1
+	}
+	return 0
+}
+
 //
 // Register functions
 //
@@ -144,7 +234,46 @@ func (r *Register) SetString(v string) {
 	r.t = "string"
 }
 
-// Type returns the type of a registers contents `int` vs. `string`.
+// GetFloat retrieves the floating-point content of the given register.
+// If the register contains anything else that is a fatal error.
+func (r *Register) GetFloat() float64 {
+	if r.t != "float" {
+		fmt.Printf("Error: Attempting to call GetFloat on a register holding a non-float value.\n")
+		os.Exit(3)
+	}
+	return r.f
+}
+
+// SetFloat stores the given floating-point number in the register.
+func (r *Register) SetFloat(v float64) {
+	r.f = v
+	r.t = "float"
+}
+
+// GetBig retrieves the arbitrary-precision content of the given register.
+// Integer registers are promoted, but anything else is a fatal error.
+//
+// The value returned must not be modified, as registers may share it.
+func (r *Register) GetBig() *big.Int {
+	switch r.t {
+	case "big":
+		return r.b
+	case "int":
+		return big.NewInt(int64(r.i))
+	}
+	fmt.Printf("Error: Attempting to call GetBig on a register holding a non-integer value.\n")
+	os.Exit(3)
+	return nil
+}
+
+// SetBig stores the given arbitrary-precision integer in the register.
+func (r *Register) SetBig(v *big.Int) {
+	r.b = v
+	r.t = "big"
+}
+
+// Type returns the type of a registers contents `int` vs. `string` vs.
+// `float` vs. `big`.
 func (r *Register) Type() string {
 	return (r.t)
 }
@@ -153,26 +282,41 @@ func (r *Register) Type() string {
 // Stack functions
 //
 
-// NewStack creates a new stack object.
-func NewStack() *Stack {
-	return &Stack{}
+// NewStack creates a new stack object, held in the stack segment of
+// the given CPU.
+func NewStack(c *CPU) *Stack {
+	return &Stack{cpu: c, sp: c.segment("stack").End}
 }
 
 // Empty returns boolean, is the stack empty?
 func (s *Stack) Empty() bool {
-	return (len(s.entries) <= 0)
+	return (s.sp >= s.cpu.segment("stack").End)
+}
+
+// Full returns boolean, is the stack segment exhausted?
+func (s *Stack) Full() bool {
+	return (s.sp-8 < s.cpu.segment("stack").Start)
 }
 
 // Push add a value to the stack.
 func (s *Stack) Push(value int) {
-	s.entries = append(s.entries, value)
+	var buf [8]byte
+	binary.LittleEndian.PutUint64(buf[:], uint64(value))
+
+	s.sp -= 8
+	for i, b := range buf {
+		s.cpu.writeMem(s.sp+i, b)
+	}
 }
 
 // Pop removes a value from the stack.
 func (s *Stack) Pop() int {
-	result := s.entries[0]
-	s.entries = append(s.entries[:0], s.entries[1:]...)
-	return (result)
+	var buf [8]byte
+	for i := range buf {
+		buf[i] = s.cpu.readMem(s.sp + i)
+	}
+	s.sp += 8
+	return (int(binary.LittleEndian.Uint64(buf[:])))
 }
 
 //
@@ -186,21 +330,44 @@ func NewCPU() *CPU {
 	return x
 }
 
+// OperandFault is the error raised when an instruction is given an
+// operand which can't be valid, such as a negative length.
+type OperandFault struct {
+	// Problem describes the operand.
+	Problem string
+	// IP is the address of the instruction.
+	IP int
+}
+
+// Error implements the error interface.
+func (f *OperandFault) Error() string {
+	return fmt.Sprintf("operand fault: %s at IP %04X", f.Problem, f.IP)
+}
+
+// register returns the numbered register, raising a RegisterFault if
+// there's no such register.
+func (c *CPU) register(n int) *Register {
+	if n < 0 || n >= opcode.Registers {
+		panic(&RegisterFault{Reg: n, IP: c.opIP})
+	}
+	return &c.regs[n]
+}
+
 // Reset sets the CPU into a known-good state, by setting the IP to zero.
 // and emptying all registers (i.e. setting them to zero too).
 func (c *CPU) Reset() {
-	for i := 0; i < 16; i++ {
+	for i := 0; i < opcode.Registers; i++ {
 		c.regs[i].SetInt(0)
 	}
 	c.ip = 0
-	c.stack = NewStack()
+	c.modules = nil
+	c.mapSegments()
+	c.stack = NewStack(c)
+	c.heap = NewHeap(c.segment("data"), c.heapDebug)
 }
 
 // LoadFile loads the program from the named file into RAM.
 func (c *CPU) LoadFile(path string) {
-	// Ensure we reset our state.
-	c.Reset()
-
 	// Load the file.
 	b, err := ioutil.ReadFile(path)
 	if err != nil {
@@ -208,329 +375,257 @@ func (c *CPU) LoadFile(path string) {
 		os.Exit(1)
 	}
 
-	if len(b) >= 0xFFFF {
-		fmt.Printf("Program too large for RAM!\n")
+	c.LoadBytes(b, 0)
+}
+
+// LoadBytes populates the given program into RAM, at the given address.
+// This may be the contents of a program file, or legacy bytecode without
+// a header.
+//
+// Only a program which is movable, holding no absolute addresses, may be
+// loaded anywhere but address zero.  Several such programs may share our
+// RAM, as each is added to those already loaded, with execution starting
+// at the entry point of the last.
+func (c *CPU) LoadBytes(data []byte, base int) {
+	prog, err := binfmt.Load(data)
+	if err != nil {
+		fmt.Printf("Invalid program: %s\n", err.Error())
 		os.Exit(1)
 	}
-
-	// Copy contents of file to our memory region.
-	for i := 0; i < len(b); i++ {
-		c.mem[i] = b[i]
+	if err := c.load(prog, base); err != nil {
+		fmt.Printf("%s\n", err.Error())
+		os.Exit(1)
 	}
 }
 
-// LoadBytes populates the given program into RAM.
-func (c *CPU) LoadBytes(data []byte) {
-	// Ensure we reset our state.
+// LoadProgram populates the given program into RAM, replacing any which
+// was already loaded.
+func (c *CPU) LoadProgram(prog *binfmt.Program) {
 	c.Reset()
-
-	if len(data) >= 0xFFFF {
-		fmt.Printf("Program too large for RAM!\n")
+	if err := c.load(prog, 0); err != nil {
+		fmt.Printf("%s\n", err.Error())
 		os.Exit(1)
 	}
-
-	// Copy contents of file to our memory region.
-	for i := 0; i < len(data); i++ {
-		c.mem[i] = data[i]
-	}
 }
 
-// readString reads a string from the IP position
-// Strings are prefixed by their length (two-bytes).
-func (c *CPU) readString() string {
-	// Read the length of the string we expect.
-	len := c.read2Val()
-
-	// Now build up the body of the string.
-	s := ""
-	for i := 0; i < len; i++ {
-		s += string(c.mem[c.ip+i])
+// load adds the given program to RAM at the given address, after ensuring
+// that we're able to run it.
+func (c *CPU) load(prog *binfmt.Program, base int) error {
+	if prog.Version < 1 || prog.Version > binfmt.Version {
+		return fmt.Errorf("Unsupported program version %d, we support up to %d", prog.Version, binfmt.Version)
+	}
+	if missing := prog.Features &^ opcode.AllFeatures; missing != 0 {
+		return fmt.Errorf("Program requires unsupported features %04X", missing)
+	}
+	if prog.Entry != 0 && prog.Entry >= len(prog.Code) {
+		return fmt.Errorf("Entry point %04X lies outside the code", prog.Entry)
+	}
+	if base != 0 && !prog.Movable {
+		return fmt.Errorf("Program holds absolute addresses, so cannot be loaded at %04X", base)
 	}
 
-	// Jump the IP over the length of the string.
-	c.ip += (len)
-	return s
-}
-
-// Read a two-byte number from the current IP.
-// i.e. This reads two bytes and returns a 16-bit value to the caller,
-// skipping over both bytes in the IP.
-func (c *CPU) read2Val() int {
-	l := int(c.mem[c.ip])
-	c.ip++
-	h := int(c.mem[c.ip])
-	c.ip++
+	m := module{base: base, code: len(prog.Code), data: len(prog.Data)}
+	if base < 0 || m.end() >= memSize-stackSize {
+		return fmt.Errorf("Program too large for RAM!")
+	}
+	for _, other := range c.modules {
+		if m.base < other.end() && other.base < m.end() {
+			return fmt.Errorf("Program at %04X overlaps the one loaded at %04X", m.base, other.base)
+		}
+	}
 
-	val := l + h*256
-	return (val)
+	// Copy the code, and then the data, to our memory region.
+	copy(c.mem[base:], prog.Code)
+	copy(c.mem[base+len(prog.Code):], prog.Data)
+	c.modules = append(c.modules, m)
+	sort.Slice(c.modules, func(i, j int) bool { return c.modules[i].base < c.modules[j].base })
+
+	// The code is now read-only, and the heap lives above the data of
+	// the highest program.
+	c.mapSegments()
+	heap := c.segments[len(c.segments)-2]
+	heap.Start = c.modules[len(c.modules)-1].end()
+	c.heap = NewHeap(heap, c.heapDebug)
+	debugPrintf("Memory layout:\n%s\n", c.dumpSegments())
+
+	c.ip = base + prog.Entry
+	return nil
 }
 
 // Run launches our interpreter.
-func (c *CPU) Run() {
+//
+// Each instruction is decoded via the instruction table, in the opcode
+// package, which tells us its operands and length.
+//
+// If the program makes an invalid access to RAM a *MemoryFault is
+// returned, describing the faulting address and instruction, and if it
+// misuses the heap a *HeapError is returned.  An instruction naming a
+// register which doesn't exist returns a *RegisterFault, and one given an
+// operand which can't be valid an *OperandFault.
+func (c *CPU) Run() (err error) {
+	defer func() {
+		if r := recover(); r != nil {
+			switch fault := r.(type) {
+			case *MemoryFault:
+				err = fault
+			case *HeapError:
+				err = fault
+			case *RegisterFault:
+				err = fault
+			case *OperandFault:
+				err = fault
+			default:
+				panic(r)
+			}
+		}
+	}()
+
 	run := true
 	for run {
-		instruction := c.mem[c.ip]
-		debugPrintf("About to execute instruction %02X\n", instruction)
+		c.opIP = c.ip
+		d, ok := opcode.Decode(c.readCode, c.ip)
+		if !ok {
+			fmt.Printf("Unrecognized/Unimplemented opcode %02X at IP %04X\n", c.mem[c.ip], c.ip)
+			os.Exit(1)
+		}
+		debugPrintf("About to execute instruction %02X\n", d.Code)
+		debugPrintf("%s\n", d.Name)
+
+		// Skip over the instruction, jumps will override this.
+		c.ip += d.Length
+
+		// The operands, and the registers they name.
+		arg := d.Args
+		reg := func(n int) *Register {
+			return c.register(arg[n].Int)
+		}
 
-		switch instruction {
-		case 0x00:
-			debugPrintf("EXIT\n")
+		switch d.Code {
+		case opcode.EXIT:
 			run = false
 
-		case 0x01:
-			debugPrintf("INT_STORE\n")
-			// register
-			c.ip++
-			reg := int(c.mem[c.ip])
-			c.ip++
-			val := c.read2Val()
-
-			debugPrintf("\tSet register %02X to %04X\n", reg, val)
-			c.regs[reg].SetInt(val)
-
-		case 0x02:
-			debugPrintf("INT_PRINT\n")
-			// register
-			c.ip++
-			reg := c.mem[c.ip]
-
-			val := c.regs[reg].GetInt()
-			if val < 256 {
-				fmt.Printf("%02X", val)
-			} else {
-				fmt.Printf("%04X", val)
+			if c.heapDebug {
+				c.leakReport()
 			}
-			c.ip++
 
-		case 0x03:
-			debugPrintf("INT_TOSTRING\n")
-			// register
-			c.ip++
-			reg := c.mem[c.ip]
+		case opcode.INT_STORE:
+			debugPrintf("\tSet register %02X to %04X\n", arg[0].Int, arg[1].Int)
+			reg(0).SetInt(arg[1].Int)
 
-			// get value
-			i := c.regs[reg].GetInt()
+		case opcode.INT_PRINT:
+			fmt.Printf("%s", c.formatInt(reg(0).GetInt()))
 
+		case opcode.INT_TOSTRING:
 			// change from int to string
-			c.regs[reg].SetString(fmt.Sprintf("%d", i))
-
-			// next instruction
-			c.ip++
-
-		case 0x04:
-			debugPrintf("INT_RANDOM\n")
-			// register
-			c.ip++
-			reg := c.mem[c.ip]
+			reg(0).SetString(fmt.Sprintf("%d", reg(0).GetInt()))
 
+		case opcode.INT_RANDOM:
 			// New random source
 			s1 := rand.NewSource(time.Now().UnixNano())
 			r1 := rand.New(s1)
 
 			// New random number
-			c.regs[reg].SetInt(r1.Intn(0xffff))
-			c.ip++
-
-		case 0x10:
-			debugPrintf("JUMP\n")
-			c.ip++
-			addr := c.read2Val()
-			c.ip = addr
-
-		case 0x11:
-			debugPrintf("JUMP_Z\n")
-			c.ip++
-			addr := c.read2Val()
+			reg(0).SetInt(r1.Intn(0xffff))
+
+		case opcode.PRINTF:
+			fmt.Printf("%s", c.sprintf(reg(0).GetString(), arg[1].Regs))
+
+		case opcode.PRINT_MODE:
+			c.printMode = PrintMode(arg[0].Int)
+
+		case opcode.JUMP_TO, opcode.JUMP_REL:
+			c.ip = arg[0].Int
+
+		case opcode.JUMP_REG:
+			c.ip = c.target(reg(0).GetInt())
+
+		case opcode.JUMP_Z, opcode.JUMP_Z_REL:
 			if c.flags.z {
-				c.ip = addr
+				c.ip = arg[0].Int
 			}
 
-		case 0x12:
-			debugPrintf("JUMP_NZ\n")
-			c.ip++
-			addr := c.read2Val()
+		case opcode.JUMP_NZ, opcode.JUMP_NZ_REL:
 			if !c.flags.z {
-				c.ip = addr
-			}
-
-		case 0x13:
-			debugPrintf("XOR\n")
-			c.ip++
-			reg := c.mem[c.ip]
-			c.ip++
-			a := c.mem[c.ip]
-			c.ip++
-			b := c.mem[c.ip]
-			c.ip++
-
-			// store result
-			aVal := c.regs[a].GetInt()
-			bVal := c.regs[b].GetInt()
-			c.regs[reg].SetInt(aVal ^ bVal)
-
-		case 0x21:
-			debugPrintf("ADD\n")
-			c.ip++
-			reg := c.mem[c.ip]
-			c.ip++
-			a := c.mem[c.ip]
-			c.ip++
-			b := c.mem[c.ip]
-			c.ip++
-
-			// store result
-			aVal := c.regs[a].GetInt()
-			bVal := c.regs[b].GetInt()
-			c.regs[reg].SetInt(aVal + bVal)
-
-		case 0x22:
-			debugPrintf("SUB\n")
-			c.ip++
-			reg := c.mem[c.ip]
-			c.ip++
-			a := c.mem[c.ip]
-			c.ip++
-			b := c.mem[c.ip]
-			c.ip++
-
-			// store result
-			aVal := c.regs[a].GetInt()
-			bVal := c.regs[b].GetInt()
-			c.regs[reg].SetInt(aVal - bVal)
-
-			// set the zero-flag if the result was zero or less
-			if c.regs[reg].i <= 0 {
-				c.flags.z = true
-			}
-
-		case 0x23:
-			debugPrintf("MUL\n")
-			c.ip++
-			reg := c.mem[c.ip]
-			c.ip++
-			a := c.mem[c.ip]
-			c.ip++
-			b := c.mem[c.ip]
-			c.ip++
-
-			// store result
-			aVal := c.regs[a].GetInt()
-			bVal := c.regs[b].GetInt()
-			c.regs[reg].SetInt(aVal * bVal)
-
-		case 0x24:
-			debugPrintf("DIV\n")
-			c.ip++
-			reg := c.mem[c.ip]
-			c.ip++
-			a := c.mem[c.ip]
-			c.ip++
-			b := c.mem[c.ip]
-			c.ip++
-
-			// store result
-			aVal := c.regs[a].GetInt()
-			bVal := c.regs[b].GetInt()
+				c.ip = arg[0].Int
+			}
 
-			if bVal == 0 {
-				fmt.Printf("Attempting to divide by zero - denying\n")
-				os.Exit(3)
+		case opcode.JUMP_LT, opcode.JUMP_LT_REL:
+			if c.flags.lt {
+				c.ip = arg[0].Int
 			}
-			c.regs[reg].SetInt(aVal / bVal)
-
-		case 0x25:
-			debugPrintf("INC\n")
-			// register
-			c.ip++
-			reg := c.mem[c.ip]
-			c.regs[reg].SetInt(c.regs[reg].GetInt() + 1)
-			// bump past that
-			c.ip++
-
-		case 0x26:
-			debugPrintf("DEC\n")
-			// register
-			c.ip++
-			reg := c.mem[c.ip]
-			c.regs[reg].SetInt(c.regs[reg].GetInt() - 1)
-			// bump past that
-			c.ip++
-
-		case 0x27:
-			debugPrintf("AND\n")
-			c.ip++
-			reg := c.mem[c.ip]
-			c.ip++
-			a := c.mem[c.ip]
-			c.ip++
-			b := c.mem[c.ip]
-			c.ip++
-
-			// store result
-			aVal := c.regs[a].GetInt()
-			bVal := c.regs[b].GetInt()
-			c.regs[reg].SetInt(aVal & bVal)
-
-		case 0x28:
-			debugPrintf("OR\n")
-			c.ip++
-			reg := c.mem[c.ip]
-			c.ip++
-			a := c.mem[c.ip]
-			c.ip++
-			b := c.mem[c.ip]
-			c.ip++
-
-			// store result
-			aVal := c.regs[a].GetInt()
-			bVal := c.regs[b].GetInt()
-			c.regs[reg].SetInt(aVal | bVal)
-
-		case 0x30:
-			debugPrintf("STORE_STRING\n")
-			// register
-			c.ip++
-			reg := c.mem[c.ip]
-			// bump past that to the length + string
-			c.ip++
-			// read it
-			str := c.readString()
-			debugPrintf("\tRead String: '%s'\n", str)
-			// store the string
-			c.regs[reg].SetString(str)
-
-		case 0x31:
-			debugPrintf("PRINT_STRING\n")
-			// register
-			c.ip++
-			reg := c.mem[c.ip]
-			fmt.Printf("%s", c.regs[reg].GetString())
-			c.ip++
-
-		case 0x32:
-			debugPrintf("STRING_CONCAT\n")
-			c.ip++
-			reg := c.mem[c.ip]
-			c.ip++
-			a := c.mem[c.ip]
-			c.ip++
-			b := c.mem[c.ip]
-			c.ip++
-
-			// store result
-			aVal := c.regs[a].GetString()
-			bVal := c.regs[b].GetString()
-			c.regs[reg].SetString(aVal + bVal)
-
-		case 0x33:
-			debugPrintf("SYSTEM\n")
-			// register
-			c.ip++
-			reg := c.mem[c.ip]
-			c.ip++
 
+		case opcode.JUMP_GT, opcode.JUMP_GT_REL:
+			if c.flags.gt {
+				c.ip = arg[0].Int
+			}
+
+		case opcode.XOR_OP, opcode.XOR_IMMEDIATE:
+			c.aluBinary(d, opXor)
+
+		case opcode.ADD_OP, opcode.ADD_IMMEDIATE:
+			c.aluBinary(d, opAdd)
+
+		case opcode.SUB_OP, opcode.SUB_IMMEDIATE:
+			c.aluBinary(d, opSub)
+
+		case opcode.MUL_OP, opcode.MUL_IMMEDIATE:
+			c.aluBinary(d, opMul)
+
+		case opcode.DIV_OP, opcode.DIV_IMMEDIATE:
+			c.aluBinary(d, opDiv)
+
+		case opcode.AND_OP, opcode.AND_IMMEDIATE:
+			c.aluBinary(d, opAnd)
+
+		case opcode.OR_OP, opcode.OR_IMMEDIATE:
+			c.aluBinary(d, opOr)
+
+		case opcode.MOD_OP, opcode.MOD_IMMEDIATE:
+			c.aluBinary(d, opMod)
+
+		case opcode.SHL_OP, opcode.SHL_IMMEDIATE:
+			c.aluBinary(d, opShl)
+
+		case opcode.SHR_OP, opcode.SHR_IMMEDIATE:
+			c.aluBinary(d, opShr)
+
+		case opcode.SAR_OP, opcode.SAR_IMMEDIATE:
+			c.aluBinary(d, opSar)
+
+		case opcode.MIN_OP, opcode.MIN_IMMEDIATE:
+			c.aluBinary(d, opMin)
+
+		case opcode.MAX_OP, opcode.MAX_IMMEDIATE:
+			c.aluBinary(d, opMax)
+
+		case opcode.INC_OP:
+			c.setResult(byte(arg[0].Int), reg(0).GetInt()+1)
+
+		case opcode.DEC_OP:
+			c.setResult(byte(arg[0].Int), reg(0).GetInt()-1)
+
+		case opcode.NOT_OP:
+			c.aluUnary(d, opNot)
+
+		case opcode.NEG_OP:
+			c.aluUnary(d, opNeg)
+
+		case opcode.ABS_OP:
+			c.aluUnary(d, opAbs)
+
+		case opcode.STRING_STORE:
+			debugPrintf("\tRead String: '%s'\n", arg[1].Str)
+			reg(0).SetString(arg[1].Str)
+
+		case opcode.STRING_PRINT:
+			fmt.Printf("%s", reg(0).GetString())
+
+		case opcode.STRING_CONCAT:
+			reg(0).SetString(reg(1).GetString() + reg(2).GetString())
+
+		case opcode.STRING_SYSTEM:
 			// run the command
-			toExec := splitCommand(c.regs[reg].GetString())
+			toExec := splitCommand(reg(0).GetString())
 			cmd := exec.Command(toExec[0], toExec[1:]...)
 
 			var out bytes.Buffer
@@ -546,225 +641,406 @@ func (c *CPU) Run() {
 				fmt.Printf("%s", err.String())
 			}
 
-		case 0x34:
-			debugPrintf("STRING_TOINT\n")
-			// register
-			c.ip++
-			reg := c.mem[c.ip]
-
-			// get value
-			s := c.regs[reg].GetString()
+		case opcode.STRING_TOINT:
+			s := reg(0).GetString()
 			i, err := strconv.Atoi(s)
 			if err == nil {
-				c.regs[reg].SetInt(i)
+				reg(0).SetInt(i)
 			} else {
 				fmt.Printf("Failed to convert '%s' to int: %s", s, err.Error())
 				os.Exit(3)
 			}
 
-			// next instruction
-			c.ip++
-
-		case 0x40:
-			debugPrintf("CMP_REG\n")
-			c.ip++
-			r1 := int(c.mem[c.ip])
-			c.ip++
-			r2 := int(c.mem[c.ip])
-			c.ip++
+		case opcode.STRING_LOAD:
+			// read the string from RAM: dst, address, length
+			reg(0).SetString(c.readMemString(reg(1).GetInt(), reg(2).GetInt()))
+
+		case opcode.STRING_SAVE:
+			// write the string to RAM: src, address
+			c.writeMemString(reg(1).GetInt(), reg(0).GetString())
+
+		case opcode.STRING_LOADP:
+			// the string is prefixed by its length (two-bytes)
+			addr := reg(1).GetInt()
+			len := int(c.readMem(addr)) + int(c.readMem(addr+1))*256
+			reg(0).SetString(c.readMemString(addr+2, len))
+
+		case opcode.STRING_SAVEP:
+			// write the length (two-bytes), then the string
+			addr := reg(1).GetInt()
+			str := reg(0).GetString()
+			if len(str) > 0xFFFF {
+				fmt.Printf("String too long to store: %d bytes\n", len(str))
+				os.Exit(3)
+			}
+			c.writeMem(addr, byte(len(str)%256))
+			c.writeMem(addr+1, byte(len(str)/256))
+			c.writeMemString(addr+2, str)
+
+		case opcode.STRING_CHR:
+			// change from int to a single-character string
+			reg(0).SetString(string(rune(reg(0).GetInt())))
+
+		case opcode.STRING_ORD:
+			// change from a single-character string to an int
+			r := []rune(reg(0).GetString())
+			if len(r) != 1 {
+				fmt.Printf("Failed to convert '%s' to int: not a single character\n", reg(0).GetString())
+				os.Exit(3)
+			}
+			reg(0).SetInt(int(r[0]))
 
-			c.flags.z = false
+		case opcode.CMP_REG:
+			r1, r2 := reg(0), reg(1)
+			c.flags.unordered()
 
-			switch c.regs[r1].Type() {
+			switch r1.Type() {
 			case "int":
-				if c.regs[r1].GetInt() == c.regs[r2].GetInt() {
-					c.flags.z = true
-				}
+				c.flags.setOrder(compareInt(r1.GetInt(), r2.GetInt()))
 			case "string":
-				if c.regs[r1].GetString() == c.regs[r2].GetString() {
-					c.flags.z = true
-				}
+				c.flags.setOrder(strings.Compare(r1.GetString(), r2.GetString()))
+			case "float":
+				c.flags.setOrder(compareFloat(r1.GetFloat(), r2.GetFloat()))
+			case "big":
+				c.flags.setOrder(r1.GetBig().Cmp(r2.GetBig()))
 			}
 
-		case 0x41:
-			debugPrintf("CMP_IMMEDIATE\n")
-			c.ip++
-			reg := int(c.mem[c.ip])
-			c.ip++
-			val := c.read2Val()
+		case opcode.CMP_IMMEDIATE:
+			if reg(0).Type() == "int" {
+				c.flags.setOrder(compareInt(reg(0).GetInt(), arg[1].Int))
+			} else {
+				c.flags.unordered()
+			}
 
-			if c.regs[reg].Type() == "int" && c.regs[reg].GetInt() == val {
-				c.flags.z = true
+		case opcode.CMP_STRING:
+			if reg(0).Type() == "string" {
+				c.flags.setOrder(strings.Compare(reg(0).GetString(), arg[1].Str))
 			} else {
-				c.flags.z = false
+				c.flags.unordered()
 			}
 
-		case 0x42:
-			debugPrintf("CMP_STR\n")
-			c.ip++
-			reg := int(c.mem[c.ip])
-			c.ip++
+		case opcode.IS_STRING:
+			c.flags.z = reg(0).Type() == "string"
 
-			str := c.readString()
+		case opcode.IS_INTEGER:
+			c.flags.z = reg(0).Type() == "int"
 
-			if c.regs[reg].Type() == "string" && c.regs[reg].GetString() == str {
-				c.flags.z = true
-			} else {
-				c.flags.z = false
+		case opcode.STRING_CMP:
+			c.flags.setOrder(strings.Compare(reg(0).GetString(), reg(1).GetString()))
+
+		case opcode.NOP_OP:
+
+		case opcode.REG_STORE:
+			// copy the source register to the destination
+			*reg(0) = *reg(1)
+
+		case opcode.PEEK:
+			// store the contents of the address in the source register
+			reg(0).SetInt(int(c.readMem(reg(1).GetInt())))
+
+		case opcode.POKE:
+			// the destination contains an address, put the contents
+			// of the source there.
+			addr := reg(1).GetInt()
+			val := reg(0).GetInt()
+
+			debugPrintf("Writing %02X to %04X\n", val, addr)
+			c.writeMem(addr, byte(val))
+
+		case opcode.MEMCPY:
+			// get the addresses from the registers
+			src_addr := reg(1).GetInt()
+			dst_addr := reg(0).GetInt()
+			length := reg(2).GetInt()
+
+			i := 0
+			for i < length {
+				c.writeMem(dst_addr, c.readMem(src_addr))
+				dst_addr += 1
+				src_addr += 1
+				i += 1
 			}
 
-		case 0x43:
-			debugPrintf("IS_STRING\n")
-			c.ip++
-			reg := int(c.mem[c.ip])
-			c.ip++
+		case opcode.ALLOC:
+			// Allocate, and zero, the block.
+			size := reg(1).GetInt()
+			addr := c.heap.Alloc(size)
+			for i := 0; addr != 0 && i < size; i++ {
+				c.mem[addr+i] = 0
+			}
+			debugPrintf("\tAllocated %d bytes at %04X\n", size, addr)
+			reg(0).SetInt(addr)
 
-			if c.regs[reg].Type() == "string" {
-				c.flags.z = true
-			} else {
-				c.flags.z = false
+		case opcode.FREE:
+			addr := reg(0).GetInt()
+			if problem := c.heap.Free(addr); problem != "" {
+				panic(&HeapError{Problem: problem, Addr: addr, IP: c.opIP})
 			}
 
-		case 0x44:
-			debugPrintf("IS_INT\n")
-			c.ip++
-			reg := int(c.mem[c.ip])
-			c.ip++
+		case opcode.STRING_LENGTH:
+			reg(0).SetInt(len([]rune(reg(1).GetString())))
 
-			if c.regs[reg].Type() == "int" {
-				c.flags.z = true
-			} else {
-				c.flags.z = false
+		case opcode.STRING_SUBSTR:
+			str := []rune(reg(1).GetString())
+			from := reg(2).GetInt()
+			to := from + reg(3).GetInt()
+			if from < 0 || to < from || to > len(str) {
+				fmt.Printf("Substring %d:%d out of range for '%s'\n", from, to, string(str))
+				os.Exit(3)
 			}
+			reg(0).SetString(string(str[from:to]))
+
+		case opcode.STRING_INDEX:
+			// find the byte-offset, and convert it to a character-offset
+			str := reg(1).GetString()
+			i := strings.Index(str, reg(2).GetString())
+			if i >= 0 {
+				i = len([]rune(str[:i]))
+			}
+			reg(0).SetInt(i)
 
-		case 0x50:
-			debugPrintf("NOP\n")
-			c.ip++
+		case opcode.STRING_CHARAT:
+			str := []rune(reg(1).GetString())
+			i := reg(2).GetInt()
+			if i < 0 || i >= len(str) {
+				fmt.Printf("Index %d out of range for '%s'\n", i, string(str))
+				os.Exit(3)
+			}
+			reg(0).SetString(string(str[i]))
+
+		case opcode.STRING_REPLACE:
+			reg(0).SetString(strings.ReplaceAll(reg(1).GetString(), reg(2).GetString(), reg(3).GetString()))
+
+		case opcode.STRING_UPPER:
+			reg(0).SetString(strings.ToUpper(reg(0).GetString()))
+
+		case opcode.STRING_LOWER:
+			reg(0).SetString(strings.ToLower(reg(0).GetString()))
+
+		case opcode.STRING_TRIM:
+			reg(0).SetString(strings.TrimSpace(reg(0).GetString()))
+
+		case opcode.STRING_SPLIT:
+			// Each piece is written to RAM prefixed by its length
+			// (two-bytes), one after the other, and we store the
+			// number of pieces.
+			pieces := strings.Split(reg(1).GetString(), reg(2).GetString())
+			addr := reg(3).GetInt()
+			for _, piece := range pieces {
+				c.writeMem(addr, byte(len(piece)%256))
+				c.writeMem(addr+1, byte(len(piece)/256))
+				c.writeMemString(addr+2, piece)
+				addr += 2 + len(piece)
+			}
+			reg(0).SetInt(len(pieces))
 
-		case 0x51:
-			debugPrintf("STORE\n")
-			c.ip++
-			dst := int(c.mem[c.ip])
-			c.ip++
-			src := int(c.mem[c.ip])
-			c.ip++
+		case opcode.STRING_BLENGTH:
+			reg(0).SetInt(len(reg(1).GetString()))
 
-			c.regs[src] = c.regs[dst]
+		case opcode.STRING_BSUBSTR:
+			str := reg(1).GetString()
+			from := reg(2).GetInt()
+			to := from + reg(3).GetInt()
+			if from < 0 || to < from || to > len(str) {
+				fmt.Printf("Substring %d:%d out of range for '%s'\n", from, to, str)
+				os.Exit(3)
+			}
+			reg(0).SetString(str[from:to])
 
-		case 0x60:
-			debugPrintf("PEEK\n")
-			c.ip++
-			result := int(c.mem[c.ip])
-			c.ip++
-			src := int(c.mem[c.ip])
+		case opcode.STRING_BINDEX:
+			reg(0).SetInt(strings.Index(reg(1).GetString(), reg(2).GetString()))
 
-			// get the address from the src register contents.
-			addr := c.regs[src].i
+		case opcode.STRING_BYTEAT:
+			str := reg(1).GetString()
+			i := reg(2).GetInt()
+			if i < 0 || i >= len(str) {
+				fmt.Printf("Index %d out of range for '%s'\n", i, str)
+				os.Exit(3)
+			}
+			reg(0).SetInt(int(str[i]))
 
-			// store the contents of the given address.
-			c.regs[result].SetInt(int(c.mem[addr]))
-			c.ip++
+		case opcode.FLOAT_STORE:
+			debugPrintf("\tSet register %02X to %g\n", arg[0].Int, arg[1].Float)
+			reg(0).SetFloat(arg[1].Float)
 
-		case 0x61:
-			debugPrintf("POKE\n")
-			c.ip++
-			src := int(c.mem[c.ip])
-			c.ip++
+		case opcode.FLOAT_ADD:
+			reg(0).SetFloat(reg(1).GetFloat() + reg(2).GetFloat())
 
-			dst := int(c.mem[c.ip])
-			c.ip++
+		case opcode.FLOAT_SUB:
+			reg(0).SetFloat(reg(1).GetFloat() - reg(2).GetFloat())
 
-			// So the destination will contain an address
-			// put the contents of the source to that.
-			addr := c.regs[dst].i
-			val := c.regs[src].i
+		case opcode.FLOAT_MUL:
+			reg(0).SetFloat(reg(1).GetFloat() * reg(2).GetFloat())
 
-			debugPrintf("Writing %02X to %04X\n", val, addr)
-			c.mem[addr] = byte(val)
+		case opcode.FLOAT_DIV:
+			bVal := reg(2).GetFloat()
+			if bVal == 0 {
+				fmt.Printf("Attempting to divide by zero - denying\n")
+				os.Exit(3)
+			}
+			reg(0).SetFloat(reg(1).GetFloat() / bVal)
 
-		case 0x62:
-			debugPrintf("MEMCPY\n")
-			c.ip++
-			dst := int(c.mem[c.ip])
-			c.ip++
+		case opcode.FLOAT_CMP:
+			c.flags.setOrder(compareFloat(reg(0).GetFloat(), reg(1).GetFloat()))
 
-			src := int(c.mem[c.ip])
-			c.ip++
+		case opcode.FLOAT_SQRT:
+			reg(0).SetFloat(math.Sqrt(reg(1).GetFloat()))
 
-			len := int(c.mem[c.ip])
-			c.ip++
+		case opcode.FLOAT_FLOOR:
+			reg(0).SetFloat(math.Floor(reg(1).GetFloat()))
 
-			// get the addresses from the registers
-			src_addr := c.regs[src].GetInt()
-			dst_addr := c.regs[dst].GetInt()
-			length := c.regs[len].GetInt()
+		case opcode.FLOAT_CEIL:
+			reg(0).SetFloat(math.Ceil(reg(1).GetFloat()))
 
-			i := 0
-			for i < length {
-				if dst_addr >= 0xFFFF {
-					dst_addr = 0
-				}
-				if src_addr >= 0xFFFF {
-					src_addr = 0
-				}
-
-				c.mem[dst_addr] = c.mem[src_addr]
-				dst_addr += 1
-				src_addr += 1
-				i += 1
+		case opcode.INT_TOFLOAT:
+			reg(0).SetFloat(float64(reg(0).GetInt()))
+
+		case opcode.FLOAT_TOINT:
+			// truncate towards zero
+			reg(0).SetInt(int(reg(0).GetFloat()))
+
+		case opcode.FLOAT_TOSTRING:
+			reg(0).SetString(strconv.FormatFloat(reg(0).GetFloat(), 'g', -1, 64))
+
+		case opcode.STRING_TOFLOAT:
+			s := reg(0).GetString()
+			f, err := strconv.ParseFloat(s, 64)
+			if err == nil {
+				reg(0).SetFloat(f)
+			} else {
+				fmt.Printf("Failed to convert '%s' to float: %s", s, err.Error())
+				os.Exit(3)
 			}
 
-		case 0x70:
-			debugPrintf("PUSH\n")
-			c.ip++
-			reg := int(c.mem[c.ip])
-			c.ip++
+		case opcode.FLOAT_PRINT:
+			fmt.Printf("%s", strconv.FormatFloat(reg(0).GetFloat(), 'g', -1, 64))
 
-			// Store the value in the register on stack
-			c.stack.Push(c.regs[reg].GetInt())
+		case opcode.IS_FLOAT:
+			c.flags.z = reg(0).Type() == "float"
 
-		case 0x71:
-			debugPrintf("POP\n")
-			c.ip++
-			reg := int(c.mem[c.ip])
-			c.ip++
+		case opcode.INT_TOBIG:
+			reg(0).SetBig(big.NewInt(int64(reg(0).GetInt())))
 
-			if c.stack.Empty() {
-				fmt.Printf("Stack Underflow!\n")
+		case opcode.BIG_ADD:
+			reg(0).SetBig(new(big.Int).Add(reg(1).GetBig(), reg(2).GetBig()))
+
+		case opcode.BIG_SUB:
+			reg(0).SetBig(new(big.Int).Sub(reg(1).GetBig(), reg(2).GetBig()))
+
+		case opcode.BIG_MUL:
+			reg(0).SetBig(new(big.Int).Mul(reg(1).GetBig(), reg(2).GetBig()))
+
+		case opcode.BIG_DIV, opcode.BIG_MOD:
+			aVal := reg(1).GetBig()
+			bVal := reg(2).GetBig()
+			if bVal.Sign() == 0 {
+				fmt.Printf("Attempting to divide by zero - denying\n")
+				os.Exit(3)
+			}
+			if d.Code == opcode.BIG_DIV {
+				reg(0).SetBig(new(big.Int).Div(aVal, bVal))
+			} else {
+				reg(0).SetBig(new(big.Int).Mod(aVal, bVal))
+			}
+
+		case opcode.BIG_POW:
+			bVal := reg(2).GetBig()
+			if bVal.Sign() < 0 {
+				fmt.Printf("Attempting to raise to a negative power - denying\n")
+				os.Exit(3)
+			}
+			reg(0).SetBig(new(big.Int).Exp(reg(1).GetBig(), bVal, nil))
+
+		case opcode.BIG_CMP:
+			c.flags.setOrder(reg(0).GetBig().Cmp(reg(1).GetBig()))
+
+		case opcode.BIG_TOSTRING:
+			reg(0).SetString(reg(0).GetBig().String())
+
+		case opcode.STRING_TOBIG:
+			s := reg(0).GetString()
+			b, ok := new(big.Int).SetString(s, 10)
+			if ok {
+				reg(0).SetBig(b)
+			} else {
+				fmt.Printf("Failed to convert '%s' to big integer", s)
+				os.Exit(3)
+			}
+
+		case opcode.BIG_PRINT:
+			fmt.Printf("%s", reg(0).GetBig().String())
+
+		case opcode.BIG_TOINT:
+			b := reg(0).GetBig()
+			if !b.IsInt64() || b.Int64() != int64(int(b.Int64())) {
+				fmt.Printf("Failed to convert '%s' to int: out of range\n", b.String())
+				os.Exit(3)
+			}
+			reg(0).SetInt(int(b.Int64()))
+
+		case opcode.IS_BIG:
+			c.flags.z = reg(0).Type() == "big"
+
+		case opcode.BIG_EXPMOD:
+			// store the result of (a ** b) mod m
+			bVal := reg(2).GetBig()
+			mVal := reg(3).GetBig()
+			if mVal.Sign() <= 0 || bVal.Sign() < 0 {
+				fmt.Printf("Invalid modular exponentiation - denying\n")
+				os.Exit(3)
+			}
+			reg(0).SetBig(new(big.Int).Exp(reg(1).GetBig(), bVal, mVal))
+
+		case opcode.STACK_PUSH:
+			if c.stack.Full() {
+				fmt.Printf("Stack Overflow!\n")
 				os.Exit(1)
 			}
 			// Store the value in the register on stack
-			c.regs[reg].SetInt(c.stack.Pop())
+			c.stack.Push(reg(0).GetInt())
 
-		case 0x72:
-			debugPrintf("RET\n")
+		case opcode.STACK_POP:
+			if c.stack.Empty() {
+				fmt.Printf("Stack Underflow!\n")
+				os.Exit(1)
+			}
+			// Store the value from the stack in the register
+			reg(0).SetInt(c.stack.Pop())
 
+		case opcode.STACK_RET:
 			// Ensure our stack isn't empty
 			if c.stack.Empty() {
 				fmt.Printf("Stack Underflow!\n")
 				os.Exit(1)
 			}
+			c.ip = c.stack.Pop()
 
-			addr := c.stack.Pop()
-			c.ip = addr
-
-		case 0x73:
-			debugPrintf("CALL\n")
-			c.ip++
-
-			addr := c.read2Val()
+		case opcode.STACK_CALL, opcode.CALL_REL:
+			if c.stack.Full() {
+				fmt.Printf("Stack Overflow!\n")
+				os.Exit(1)
+			}
+			c.stack.Push(c.ip)
+			c.ip = arg[0].Int
 
+		case opcode.CALL_REG:
+			target := c.target(reg(0).GetInt())
+			if c.stack.Full() {
+				fmt.Printf("Stack Overflow!\n")
+				os.Exit(1)
+			}
 			c.stack.Push(c.ip)
-			c.ip = addr
+			c.ip = target
 
 		default:
-			fmt.Printf("Unrecognized/Unimplemented opcode %02X at IP %04X\n", instruction, c.ip)
+			fmt.Printf("Unrecognized/Unimplemented opcode %02X at IP %04X\n", d.Code, c.opIP)
 			os.Exit(1)
 		}
 
 		// Ensure our instruction-pointer wraps around.
-		if c.ip >= 0xFFFF {
+		if c.ip >= memSize {
 			c.ip = 0
 		}
 	}
+	return nil
 }
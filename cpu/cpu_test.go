@@ -0,0 +1,560 @@
+package cpu
+
+import (
+	"errors"
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"gosc-vm/binfmt"
+	"gosc-vm/compiler"
+	"gosc-vm/lexer"
+)
+
+func TestStringUTF8(t *testing.T) {
+	// store #1, "héllo" ; strlen #2, #1 ; strblen #3, #1 ; exit
+	prog := []byte{0x30, 0x01, 0x06, 0x00}
+	prog = append(prog, "héllo"...)
+	prog = append(prog,
+		0x90, 0x02, 0x01,
+		0x99, 0x03, 0x01,
+		0x00)
+
+	c := NewCPU()
+	c.LoadBytes(prog, 0)
+	if err := c.Run(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if c.regs[1].GetString() != "héllo" {
+		t.Fatalf("string mangled: %q", c.regs[1].GetString())
+	}
+	if c.regs[2].GetInt() != 5 {
+		t.Fatalf("expected 5 characters, got %d", c.regs[2].GetInt())
+	}
+	if c.regs[3].GetInt() != 6 {
+		t.Fatalf("expected 6 bytes, got %d", c.regs[3].GetInt())
+	}
+}
+
+func TestSprintf(t *testing.T) {
+	c := NewCPU()
+	c.regs[1].SetInt(42)
+	c.regs[2].SetString("ab")
+	c.regs[3].SetInt(65)
+
+	tests := []struct {
+		format   string
+		regs     []byte
+		expected string
+	}{
+		{"%d\n", []byte{1}, "42\n"},
+		{"[%5d|%-4s|%04x]", []byte{1, 2, 1}, "[   42|ab  |002a]"},
+		{"%c%c", []byte{3, 2}, "Aab"},
+		{"100%% %s", []byte{1}, "100% 42"},
+		{"%d %d", []byte{1}, "42 %!d(MISSING)"},
+	}
+
+	for _, tt := range tests {
+		out := c.sprintf(tt.format, tt.regs)
+		if out != tt.expected {
+			t.Fatalf("format %q - expected %q, got %q", tt.format, tt.expected, out)
+		}
+	}
+}
+
+func TestALUImmediateFlags(t *testing.T) {
+	// store #1, 12 ; sub #2, #1, 13 ; exit
+	prog := []byte{
+		0x01, 0x01, 0x0C, 0x00,
+		0x82, 0x02, 0x01, 0x0D, 0x00,
+		0x00,
+	}
+
+	c := NewCPU()
+	c.LoadBytes(prog, 0)
+	if err := c.Run(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if c.regs[2].GetInt() != -1 {
+		t.Fatalf("expected -1, got %d", c.regs[2].GetInt())
+	}
+	if c.flags.z || !c.flags.lt || c.flags.gt {
+		t.Fatalf("unexpected flags %+v", c.flags)
+	}
+}
+
+func TestJumpRegister(t *testing.T) {
+	// store #1, 12 ; call #1 ; store #3, 15 ; jmp #3 ; inc #2 ; ret ; exit
+	prog := []byte{
+		0x01, 0x01, 0x0C, 0x00,
+		0x74, 0x01,
+		0x01, 0x03, 0x0F, 0x00,
+		0x13, 0x03,
+		0x25, 0x02,
+		0x72,
+		0x00,
+	}
+
+	c := NewCPU()
+	c.LoadBytes(prog, 0)
+	if err := c.Run(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if c.regs[2].GetInt() != 1 {
+		t.Fatalf("expected one call, got %d", c.regs[2].GetInt())
+	}
+}
+
+func TestLoadAtBase(t *testing.T) {
+	// inc #2 ; jmp over ; over: ret
+	lib := []byte{
+		0x25, 0x02,
+		0x16, 0x00, 0x00,
+		0x72,
+	}
+	// store #1, 0x100 ; call #1 ; call #1 ; exit
+	prog := []byte{
+		0x01, 0x01, 0x00, 0x01,
+		0x74, 0x01,
+		0x74, 0x01,
+		0x00,
+	}
+
+	c := NewCPU()
+	c.LoadBytes((&binfmt.Program{Version: binfmt.Version, Code: lib, Movable: true}).Encode(), 0x100)
+	c.LoadBytes((&binfmt.Program{Version: binfmt.Version, Code: prog, Movable: true}).Encode(), 0x200)
+	if err := c.Run(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if c.regs[2].GetInt() != 2 {
+		t.Fatalf("expected two calls, got %d", c.regs[2].GetInt())
+	}
+	if c.segment("code").Start != 0x100 {
+		t.Fatalf("unexpected layout:\n%s", c.dumpSegments())
+	}
+}
+
+func TestLoadAbsoluteAtBase(t *testing.T) {
+	e := compiler.New(lexer.New(`
+	.absolute
+	jmp end
+:end
+	exit
+`))
+	e.Compile()
+	prog := e.Program()
+
+	c := NewCPU()
+	if err := c.load(prog, 0x100); err == nil {
+		t.Fatalf("loaded a program with absolute jumps at 0100")
+	}
+
+	// Nor may the address of a label be used, as a value.
+	e = compiler.New(lexer.New(`
+	store #1, end
+:end
+	exit
+`))
+	e.Compile()
+	if err := c.load(e.Program(), 0x100); err == nil {
+		t.Fatalf("loaded a program using the address of a label at 0100")
+	}
+
+	// Nor legacy bytecode, which can't say.
+	legacy, _ := binfmt.Load([]byte{0x00})
+	if err := c.load(legacy, 0x100); err == nil {
+		t.Fatalf("loaded legacy bytecode at 0100")
+	}
+
+	e = compiler.New(lexer.New(`
+	jmp end
+	store #1, end - start
+:start
+:end
+	exit
+`))
+	e.Compile()
+	if err := c.load(e.Program(), 0x100); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+}
+
+func TestInvalidRegister(t *testing.T) {
+	tests := []struct {
+		prog []byte
+		reg  int
+		ip   int
+	}{
+		// inc #20 ; exit
+		{[]byte{0x25, 20, 0x00}, 20, 0},
+		// add #1, #99, 1 ; exit
+		{[]byte{0x81, 1, 99, 1, 0, 0x00}, 99, 0},
+		// store #1, "%d" ; printf #1, #200 ; exit
+		{[]byte{0x30, 1, 2, 0, '%', 'd', 0x05, 1, 1, 200, 0x00}, 200, 6},
+	}
+	for i, tt := range tests {
+		c := NewCPU()
+		c.LoadBytes(tt.prog, 0)
+		err := c.Run()
+
+		var fault *RegisterFault
+		if !errors.As(err, &fault) {
+			t.Errorf("tests[%d]: expected a register fault, got %v", i, err)
+			continue
+		}
+		if fault.Reg != tt.reg || fault.IP != tt.ip {
+			t.Errorf("tests[%d]: unexpected fault %+v", i, fault)
+		}
+	}
+}
+
+// run compiles the given source, and runs it.
+func run(t *testing.T, src string) (*CPU, error) {
+	t.Helper()
+	e := compiler.New(lexer.New(src))
+	e.Compile()
+
+	c := NewCPU()
+	c.LoadProgram(e.Program())
+	return c, c.Run()
+}
+
+// value returns the contents of a register, of whichever type.
+func value(r *Register) interface{} {
+	switch r.Type() {
+	case "string":
+		return r.GetString()
+	case "float":
+		return r.GetFloat()
+	case "big":
+		return r.GetBig().String()
+	}
+	return r.GetInt()
+}
+
+func TestStringOpcodes(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected interface{}
+	}{
+		{`store #2, "héllo"
+	strlen #1, #2`, 5},
+		{`store #2, "héllo"
+	store #3, 1
+	store #4, 3
+	substr #1, #2, #3, #4`, "éll"},
+		{`store #2, "héllo"
+	store #3, "llo"
+	indexof #1, #2, #3`, 2},
+		{`store #2, "héllo"
+	store #3, "x"
+	indexof #1, #2, #3`, -1},
+		{`store #2, "héllo"
+	store #3, 1
+	charat #1, #2, #3`, "é"},
+		{`store #2, "a-b-c"
+	store #3, "-"
+	store #4, "+"
+	replace #1, #2, #3, #4`, "a+b+c"},
+		{`store #1, "MiXed"
+	upper #1`, "MIXED"},
+		{`store #1, "MiXed"
+	lower #1`, "mixed"},
+		{`store #1, " \tpadded\n"
+	trim #1`, "padded"},
+		{`store #2, "héllo"
+	strblen #1, #2`, 6},
+		{`store #2, "héllo"
+	store #3, 1
+	store #4, 2
+	bsubstr #1, #2, #3, #4`, "é"},
+		{`store #2, "héllo"
+	store #3, "l"
+	bindexof #1, #2, #3`, 3},
+		{`store #2, "héllo"
+	store #3, 0
+	byteat #1, #2, #3`, int('h')},
+	}
+	for i, tt := range tests {
+		c, err := run(t, "\t"+tt.src+"\n\texit\n")
+		if err != nil {
+			t.Errorf("tests[%d]: unexpected error %s", i, err)
+			continue
+		}
+		if got := value(&c.regs[1]); got != tt.expected {
+			t.Errorf("tests[%d]: expected %v, got %v", i, tt.expected, got)
+		}
+	}
+}
+
+func TestStringSplit(t *testing.T) {
+	c, err := run(t, `
+	store #2, "a,bc,,dé"
+	store #3, ","
+	store #4, buffer
+	split #1, #2, #3, #4
+	exit
+	.data
+:buffer
+	.space 32
+`)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if c.regs[1].GetInt() != 4 {
+		t.Fatalf("expected 4 pieces, got %d", c.regs[1].GetInt())
+	}
+	buffer := c.regs[4].GetInt()
+	expected := "\x01\x00a\x02\x00bc\x00\x00\x03\x00dé"
+	if got := string(c.mem[buffer : buffer+len(expected)]); got != expected {
+		t.Fatalf("expected %q, got %q", expected, got)
+	}
+}
+
+func TestStringCompare(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected Flags
+		jump     int
+	}{
+		{"apple", "banana", Flags{lt: true}, 1},
+		{"banana", "apple", Flags{gt: true}, 2},
+		{"apple", "apple", Flags{z: true}, 3},
+		{"", "a", Flags{lt: true}, 1},
+		{"Z", "a", Flags{lt: true}, 1},
+	}
+	for i, tt := range tests {
+		// both the absolute and relative jumps, which only test
+		// the flags
+		for _, mode := range []string{".relative", ".absolute"} {
+			c, err := run(t, `
+	`+mode+`
+	store #1, "`+tt.a+`"
+	store #2, "`+tt.b+`"
+	strcmp #1, #2
+	jmplt 1f
+	jmpgt 2f
+	store #3, 3
+	exit
+:1
+	store #3, 1
+	exit
+:2
+	store #3, 2
+	exit
+`)
+			if err != nil {
+				t.Errorf("tests[%d] %s: unexpected error %s", i, mode, err)
+				continue
+			}
+			if c.flags != tt.expected {
+				t.Errorf("tests[%d] %s: expected flags %+v, got %+v", i, mode, tt.expected, c.flags)
+			}
+			if c.regs[3].GetInt() != tt.jump {
+				t.Errorf("tests[%d] %s: expected to reach %d, got %d", i, mode, tt.jump, c.regs[3].GetInt())
+			}
+		}
+	}
+}
+
+func TestBigOpcodes(t *testing.T) {
+	// #2 holds 2^100, #3 holds 7, and #4 holds -7
+	setup := `
+	store #2, "1267650600228229401496703205376"
+	string2big #2
+	store #3, 7
+	int2big #3
+	store #4, 0
+	sub #4, #4, 7
+	int2big #4
+`
+	tests := []struct {
+		src      string
+		expected interface{}
+	}{
+		{`badd #1, #2, #3`, "1267650600228229401496703205383"},
+		{`bsub #1, #3, #2`, "-1267650600228229401496703205369"},
+		{`bmul #1, #2, #3`, "8873554201597605810476922437632"},
+		{`bdiv #1, #2, #3`, "181092942889747057356671886482"},
+		{`bmod #1, #2, #3`, "2"},
+		{`bdiv #1, #4, #3`, "-1"},
+		{`bmod #1, #4, #2`, "1267650600228229401496703205369"},
+		{`bpow #1, #3, #3`, "823543"},
+		{`bexpmod #1, #3, #2, #3`, "0"},
+		{`store #1, #2
+	big2string #1`, "1267650600228229401496703205376"},
+		{`store #1, #4
+	big2int #1`, -7},
+	}
+	for i, tt := range tests {
+		c, err := run(t, setup+"\t"+tt.src+"\n\texit\n")
+		if err != nil {
+			t.Errorf("tests[%d]: unexpected error %s", i, err)
+			continue
+		}
+		if got := value(&c.regs[1]); got != tt.expected {
+			t.Errorf("tests[%d]: expected %v, got %v", i, tt.expected, got)
+		}
+	}
+}
+
+func TestBigCompare(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected Flags
+	}{
+		{"1267650600228229401496703205376", "7", Flags{gt: true}},
+		{"-1267650600228229401496703205376", "7", Flags{lt: true}},
+		{"1267650600228229401496703205376", "1267650600228229401496703205376", Flags{z: true}},
+	}
+	for i, tt := range tests {
+		for _, op := range []string{"bcmp", "cmp"} {
+			c, err := run(t, `
+	store #1, "`+tt.a+`"
+	string2big #1
+	store #2, "`+tt.b+`"
+	string2big #2
+	`+op+` #1, #2
+	exit
+`)
+			if err != nil {
+				t.Errorf("tests[%d] %s: unexpected error %s", i, op, err)
+				continue
+			}
+			if c.flags != tt.expected {
+				t.Errorf("tests[%d] %s: expected flags %+v, got %+v", i, op, tt.expected, c.flags)
+			}
+		}
+	}
+
+	// an integer is promoted, to compare with a big one
+	c, err := run(t, `
+	store #1, "100"
+	string2big #1
+	store #2, 99
+	bcmp #2, #1
+	exit
+`)
+	if err != nil || c.flags != (Flags{lt: true}) {
+		t.Errorf("expected 99 < 100, got %+v, %v", c.flags, err)
+	}
+}
+
+func TestFloatOpcodes(t *testing.T) {
+	// #2 holds 7.5, and #3 holds -2.5
+	setup := `
+	store #2, 7.5
+	store #3, -2.5
+`
+	tests := []struct {
+		src      string
+		expected interface{}
+	}{
+		{`fadd #1, #2, #3`, 5.0},
+		{`fsub #1, #3, #2`, -10.0},
+		{`fmul #1, #2, #3`, -18.75},
+		{`fdiv #1, #2, #3`, -3.0},
+		{`store #4, 6.25
+	sqrt #1, #4`, 2.5},
+		{`floor #1, #3`, -3.0},
+		{`ceil #1, #3`, -2.0},
+		{`floor #1, #2`, 7.0},
+		{`ceil #1, #2`, 8.0},
+		{`store #1, 3
+	int2float #1`, 3.0},
+		{`store #1, #3
+	float2int #1`, -2},
+		{`store #1, #2
+	float2int #1`, 7},
+		{`store #1, #3
+	float2string #1`, "-2.5"},
+		{`store #1, "1e-3"
+	string2float #1`, 0.001},
+	}
+	for i, tt := range tests {
+		c, err := run(t, setup+"\t"+tt.src+"\n\texit\n")
+		if err != nil {
+			t.Errorf("tests[%d]: unexpected error %s", i, err)
+			continue
+		}
+		if got := value(&c.regs[1]); got != tt.expected {
+			t.Errorf("tests[%d]: expected %v, got %v", i, tt.expected, got)
+		}
+	}
+}
+
+func TestFloatCompare(t *testing.T) {
+	tests := []struct {
+		a, b     string
+		expected Flags
+	}{
+		{"1.5", "2.5", Flags{lt: true}},
+		{"2.5", "-2.5", Flags{gt: true}},
+		{"-0.0", "0.0", Flags{z: true}},
+	}
+	for i, tt := range tests {
+		for _, op := range []string{"fcmp", "cmp"} {
+			c, err := run(t, `
+	store #1, `+tt.a+`
+	store #2, `+tt.b+`
+	`+op+` #1, #2
+	exit
+`)
+			if err != nil {
+				t.Errorf("tests[%d] %s: unexpected error %s", i, op, err)
+				continue
+			}
+			if c.flags != tt.expected {
+				t.Errorf("tests[%d] %s: expected flags %+v, got %+v", i, op, tt.expected, c.flags)
+			}
+		}
+	}
+}
+
+func TestFloatPrint(t *testing.T) {
+	c := NewCPU()
+	c.regs[1].SetFloat(-3.5)
+	c.regs[2].SetFloat(0.1)
+	c.regs[3].SetInt(2)
+
+	tests := []struct {
+		format   string
+		regs     []byte
+		expected string
+	}{
+		{"%s", []byte{1}, "-3.5"},
+		{"%.2f|%g", []byte{1, 2}, "-3.50|0.1"},
+		{"%e", []byte{2}, "1.000000e-01"},
+		{"%.1f", []byte{3}, "2.0"},
+	}
+	for _, tt := range tests {
+		out := c.sprintf(tt.format, tt.regs)
+		if out != tt.expected {
+			t.Errorf("format %q - expected %q, got %q", tt.format, tt.expected, out)
+		}
+	}
+
+	// print_float writes as float2string converts
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	_, err = run(t, `
+	store #1, -3.5
+	print_float #1
+	store #1, 1.0e+21
+	print_float #1
+	exit
+`)
+	os.Stdout = stdout
+	w.Close()
+	out, _ := ioutil.ReadAll(r)
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if string(out) != "-3.51e+21" {
+		t.Fatalf("expected %q, got %q", "-3.51e+21", out)
+	}
+}
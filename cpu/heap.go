@@ -0,0 +1,161 @@
+package cpu
+
+import (
+	"fmt"
+	"sort"
+)
+
+// Block is a region of the heap.
+type Block struct {
+	// Addr is the first address of the block.
+	Addr int
+	// Size is the length of the block, in bytes.
+	Size int
+}
+
+// Heap is a simple first-fit allocator which manages the data segment,
+// i.e. the region of RAM above the loaded program.
+//
+// In debug mode freed blocks are never reused, which allows double-frees
+// and use-after-free accesses to be detected.
+type Heap struct {
+	// Blocks available for allocation, sorted by address
+	free []Block
+	// Allocated blocks, keyed by address
+	used map[int]int
+	// Freed blocks, keyed by address, when in debug mode
+	freed map[int]int
+	// Are we in debug mode?
+	debug bool
+}
+
+// HeapError is the error raised when a program misuses the heap.
+type HeapError struct {
+	// Problem describes the misuse, e.g. "double free".
+	Problem string
+	// Addr is the address involved.
+	Addr int
+	// IP is the address of the instruction which caused the error.
+	IP int
+}
+
+// Error implements the error interface.
+func (e *HeapError) Error() string {
+	return fmt.Sprintf("heap error: %s of address %s at IP %04X", e.Problem, hexAddr(e.Addr), e.IP)
+}
+
+// NewHeap creates a heap managing the given segment.
+func NewHeap(seg Segment, debug bool) *Heap {
+	h := &Heap{used: make(map[int]int), freed: make(map[int]int), debug: debug}
+	if seg.End > seg.Start {
+		h.free = []Block{{Addr: seg.Start, Size: seg.End - seg.Start}}
+	}
+	return h
+}
+
+// Alloc returns the address of a new block of the given size, or zero
+// if the request cannot be satisfied.
+func (h *Heap) Alloc(size int) int {
+	if size <= 0 {
+		return 0
+	}
+	for i, b := range h.free {
+		if b.Size < size {
+			continue
+		}
+		if b.Size == size {
+			h.free = append(h.free[:i], h.free[i+1:]...)
+		} else {
+			h.free[i] = Block{Addr: b.Addr + size, Size: b.Size - size}
+		}
+		h.used[b.Addr] = size
+		return b.Addr
+	}
+	return 0
+}
+
+// Free releases the block at the given address, returning a description
+// of the problem if the address is not that of an allocated block.
+//
+// Freeing the address zero does nothing.
+func (h *Heap) Free(addr int) string {
+	if addr == 0 {
+		return ""
+	}
+	size, ok := h.used[addr]
+	if !ok {
+		if _, ok := h.freed[addr]; ok {
+			return "double free"
+		}
+		return "invalid free"
+	}
+	delete(h.used, addr)
+
+	// In debug mode we keep the block out of circulation.
+	if h.debug {
+		h.freed[addr] = size
+		return ""
+	}
+
+	h.free = append(h.free, Block{Addr: addr, Size: size})
+	sort.Slice(h.free, func(i, j int) bool { return h.free[i].Addr < h.free[j].Addr })
+
+	// Merge adjacent free blocks.
+	merged := h.free[:1]
+	for _, b := range h.free[1:] {
+		last := &merged[len(merged)-1]
+		if last.Addr+last.Size == b.Addr {
+			last.Size += b.Size
+		} else {
+			merged = append(merged, b)
+		}
+	}
+	h.free = merged
+	return ""
+}
+
+// Freed returns true if the given address lies within a freed block.
+// This is only tracked in debug mode.
+func (h *Heap) Freed(addr int) bool {
+	for a, size := range h.freed {
+		if addr >= a && addr < a+size {
+			return true
+		}
+	}
+	return false
+}
+
+// Leaks returns the blocks which are still allocated, sorted by address.
+func (h *Heap) Leaks() []Block {
+	var out []Block
+	for addr, size := range h.used {
+		out = append(out, Block{Addr: addr, Size: size})
+	}
+	sort.Slice(out, func(i, j int) bool { return out[i].Addr < out[j].Addr })
+	return out
+}
+
+// SetHeapDebug enables, or disables, debug mode for the heap.
+//
+// In debug mode double-frees and use-after-free accesses are reported,
+// and any leaked blocks are listed when the program exits.
+func (c *CPU) SetHeapDebug(debug bool) {
+	c.heapDebug = debug
+	c.heap.debug = debug
+}
+
+// leakReport shows any blocks which were never freed.
+func (c *CPU) leakReport() {
+	leaks := c.heap.Leaks()
+	if len(leaks) == 0 {
+		return
+	}
+	total := 0
+	for _, b := range leaks {
+		total += b.Size
+	}
+	fmt.Printf("Leak report: %d bytes in %d block(s) still allocated\n", total, len(leaks))
+	for _, b := range leaks {
+		fmt.Printf("\t%04X: %d bytes\n", b.Addr, b.Size)
+	}
+}
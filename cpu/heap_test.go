@@ -0,0 +1,72 @@
+package cpu
+
+import (
+	"errors"
+	"testing"
+)
+
+func TestHeapReuse(t *testing.T) {
+	h := NewHeap(Segment{Start: 0x100, End: 0x200}, false)
+
+	a := h.Alloc(0x10)
+	b := h.Alloc(0x10)
+	if a != 0x100 || b != 0x110 {
+		t.Fatalf("unexpected addresses %04X %04X", a, b)
+	}
+	if h.Alloc(0x1000) != 0 {
+		t.Fatalf("expected an oversized allocation to fail")
+	}
+
+	if problem := h.Free(a); problem != "" {
+		t.Fatalf("unexpected problem %s", problem)
+	}
+	if problem := h.Free(a); problem != "invalid free" {
+		t.Fatalf("expected an invalid free, got %q", problem)
+	}
+	if h.Alloc(0x08) != a {
+		t.Fatalf("expected the freed block to be reused")
+	}
+	if len(h.Leaks()) != 2 {
+		t.Fatalf("expected two blocks to be in use, got %v", h.Leaks())
+	}
+}
+
+func TestHeapDebug(t *testing.T) {
+	h := NewHeap(Segment{Start: 0x100, End: 0x200}, true)
+
+	a := h.Alloc(0x10)
+	h.Free(a)
+	if problem := h.Free(a); problem != "double free" {
+		t.Fatalf("expected a double free, got %q", problem)
+	}
+	if !h.Freed(a + 4) {
+		t.Fatalf("expected the block to be marked as freed")
+	}
+	if h.Alloc(0x10) == a {
+		t.Fatalf("freed block was reused in debug mode")
+	}
+}
+
+func TestUseAfterFree(t *testing.T) {
+	// store #1, 4 ; alloc #2, #1 ; free #2 ; poke #1, #2 ; exit
+	prog := []byte{
+		0x01, 0x01, 0x04, 0x00,
+		0x63, 0x02, 0x01,
+		0x64, 0x02,
+		0x61, 0x01, 0x02,
+		0x00,
+	}
+
+	c := NewCPU()
+	c.SetHeapDebug(true)
+	c.LoadBytes(prog, 0)
+	err := c.Run()
+
+	var heapErr *HeapError
+	if !errors.As(err, &heapErr) {
+		t.Fatalf("expected a heap error, got %v", err)
+	}
+	if heapErr.Problem != "use after free" || heapErr.IP != 9 {
+		t.Fatalf("unexpected error %+v", heapErr)
+	}
+}
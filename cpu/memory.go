@@ -0,0 +1,224 @@
+package cpu
+
+import (
+	"fmt"
+	"strings"
+)
+
+// memSize is the number of bytes of RAM our CPU has.
+const memSize = 0xFFFF
+
+// stackSize is the number of bytes reserved for the stack segment, at
+// the very top of RAM.
+const stackSize = 0x1000
+
+// Perm holds the access-permissions of a memory segment.
+type Perm int
+
+// The permissions a segment may grant.
+const (
+	PermRead Perm = 1 << iota
+	PermWrite
+	PermExec
+)
+
+// String returns the permissions in the familiar "rwx" form.
+func (p Perm) String() string {
+	out := []byte("---")
+	if p&PermRead != 0 {
+		out[0] = 'r'
+	}
+	if p&PermWrite != 0 {
+		out[1] = 'w'
+	}
+	if p&PermExec != 0 {
+		out[2] = 'x'
+	}
+	return string(out)
+}
+
+// Segment describes a region of RAM, and what may be done with it.
+type Segment struct {
+	// Name of the segment: "code", "data", or "stack".
+	Name string
+	// Start is the first address in the segment.
+	Start int
+	// End is the address just past the last byte of the segment.
+	End int
+	// Perm holds the permitted accesses.
+	Perm Perm
+}
+
+// Contains returns true if the given address lies within the segment.
+func (s Segment) Contains(addr int) bool {
+	return addr >= s.Start && addr < s.End
+}
+
+// MemoryFault is the error raised when a program makes an access to
+// RAM which is out of bounds, or not permitted by the segment holding
+// the address.
+type MemoryFault struct {
+	// Addr is the faulting address.
+	Addr int
+	// IP is the address of the instruction which caused the fault.
+	IP int
+	// Access is the kind of access which was attempted.
+	Access Perm
+	// Segment is the name of the segment holding Addr, if any.
+	Segment string
+}
+
+// Error implements the error interface.
+func (f *MemoryFault) Error() string {
+	access := "read"
+	switch f.Access {
+	case PermWrite:
+		access = "write"
+	case PermExec:
+		access = "execute"
+	}
+	if f.Segment == "" {
+		return fmt.Sprintf("memory fault: %s of unmapped address %s at IP %04X", access, hexAddr(f.Addr), f.IP)
+	}
+	return fmt.Sprintf("memory fault: %s of address %s in %s segment at IP %04X", access, hexAddr(f.Addr), f.Segment, f.IP)
+}
+
+// hexAddr formats an address in hex, which may be negative, as when a
+// program computes one below zero.
+func hexAddr(addr int) string {
+	if addr < 0 {
+		return fmt.Sprintf("-%04X", -addr)
+	}
+	return fmt.Sprintf("%04X", addr)
+}
+
+// module is a program loaded into RAM.
+type module struct {
+	base int // the address of its code
+	code int // the size of its code
+	data int // the size of its data, which follows the code
+}
+
+// end returns the address just past the module.
+func (m module) end() int {
+	return m.base + m.code + m.data
+}
+
+// mapSegments sets up our memory layout for the programs loaded: a
+// read-only code segment holding each, followed by a data segment, and
+// the stack segment at the top of RAM.  The data segment above the last
+// program runs up to the stack, and holds the heap.
+func (c *CPU) mapSegments() {
+	stackStart := memSize - stackSize
+	c.segments = nil
+
+	free := 0
+	for i, m := range c.modules {
+		c.segments = append(c.segments, Segment{Name: "code", Start: m.base, End: m.base + m.code, Perm: PermRead | PermExec})
+		free = m.base + m.code
+		if m.data > 0 && i < len(c.modules)-1 {
+			c.segments = append(c.segments, Segment{Name: "data", Start: free, End: m.end(), Perm: PermRead | PermWrite})
+		}
+	}
+	if len(c.modules) == 0 {
+		c.segments = append(c.segments, Segment{Name: "code", Perm: PermRead | PermExec})
+	}
+	c.segments = append(c.segments,
+		Segment{Name: "data", Start: free, End: stackStart, Perm: PermRead | PermWrite},
+		Segment{Name: "stack", Start: stackStart, End: memSize, Perm: PermRead | PermWrite},
+	)
+}
+
+// Segments returns the current memory layout.
+func (c *CPU) Segments() []Segment {
+	return c.segments
+}
+
+// segment returns the named segment.
+func (c *CPU) segment(name string) Segment {
+	for _, s := range c.segments {
+		if s.Name == name {
+			return s
+		}
+	}
+	return Segment{}
+}
+
+// check ensures the given access to the address is permitted, raising a
+// MemoryFault if it is not.
+func (c *CPU) check(addr int, access Perm) {
+	for _, s := range c.segments {
+		if s.Contains(addr) {
+			if s.Perm&access == 0 {
+				panic(&MemoryFault{Addr: addr, IP: c.opIP, Access: access, Segment: s.Name})
+			}
+			return
+		}
+	}
+	panic(&MemoryFault{Addr: addr, IP: c.opIP, Access: access})
+}
+
+// target checks that a jump, or call, to an address held in a register
+// lands in executable memory, raising a MemoryFault at the jump if not.
+func (c *CPU) target(addr int) int {
+	c.check(addr, PermExec)
+	return addr
+}
+
+// readCode reads a byte of the current instruction from RAM.
+func (c *CPU) readCode(addr int) byte {
+	c.check(addr, PermExec)
+	return c.mem[addr]
+}
+
+// readMem reads a byte of data from RAM.
+func (c *CPU) readMem(addr int) byte {
+	c.check(addr, PermRead)
+	c.checkFreed(addr)
+	return c.mem[addr]
+}
+
+// writeMem writes a byte of data to RAM.
+func (c *CPU) writeMem(addr int, val byte) {
+	c.check(addr, PermWrite)
+	c.checkFreed(addr)
+	c.mem[addr] = val
+}
+
+// readMemString reads a string of the given length, in bytes, from RAM.
+// The bytes are read one at a time, so that a length which runs past the
+// end of its segment faults there.
+func (c *CPU) readMemString(addr int, len int) string {
+	if len < 0 {
+		panic(&OperandFault{Problem: fmt.Sprintf("negative length %d", len), IP: c.opIP})
+	}
+	var buf []byte
+	for i := 0; i < len; i++ {
+		buf = append(buf, c.readMem(addr+i))
+	}
+	return string(buf)
+}
+
+// writeMemString writes the bytes of the given string to RAM.
+func (c *CPU) writeMemString(addr int, str string) {
+	for i := 0; i < len(str); i++ {
+		c.writeMem(addr+i, str[i])
+	}
+}
+
+// checkFreed raises a HeapError if the heap is in debug mode and the
+// given address lies within a block which has been freed.
+func (c *CPU) checkFreed(addr int) {
+	if c.heapDebug && c.heap.Freed(addr) {
+		panic(&HeapError{Problem: "use after free", Addr: addr, IP: c.opIP})
+	}
+}
+
+// dumpSegments returns a human-readable description of the memory layout.
+func (c *CPU) dumpSegments() string {
+	var out []string
+	for _, s := range c.segments {
+		out = append(out, fmt.Sprintf("%-5s %04X-%04X %s", s.Name, s.Start, s.End, s.Perm))
+	}
+	return strings.Join(out, "\n")
+}
@@ -0,0 +1,267 @@
+package cpu
+
+import (
+	"errors"
+	"testing"
+
+	"gosc-vm/compiler"
+	"gosc-vm/lexer"
+)
+
+func TestPokeCodeSegmentFaults(t *testing.T) {
+	// store #1, 0 ; store #2, 1 ; poke #2, #1 ; exit
+	prog := []byte{
+		0x01, 0x01, 0x00, 0x00,
+		0x01, 0x02, 0x01, 0x00,
+		0x61, 0x02, 0x01,
+		0x00,
+	}
+
+	c := NewCPU()
+	c.LoadBytes(prog, 0)
+	err := c.Run()
+
+	var fault *MemoryFault
+	if !errors.As(err, &fault) {
+		t.Fatalf("expected a memory fault, got %v", err)
+	}
+	if fault.Addr != 0 || fault.IP != 8 || fault.Access != PermWrite || fault.Segment != "code" {
+		t.Fatalf("unexpected fault %+v", fault)
+	}
+}
+
+func TestPeekUnmappedFaults(t *testing.T) {
+	// store #1, 0xFFFF ; peek #0, #1 ; exit
+	prog := []byte{
+		0x01, 0x01, 0xFF, 0xFF,
+		0x60, 0x00, 0x01,
+		0x00,
+	}
+
+	c := NewCPU()
+	c.LoadBytes(prog, 0)
+	err := c.Run()
+
+	var fault *MemoryFault
+	if !errors.As(err, &fault) {
+		t.Fatalf("expected a memory fault, got %v", err)
+	}
+	if fault.Addr != 0xFFFF || fault.IP != 4 || fault.Segment != "" {
+		t.Fatalf("unexpected fault %+v", fault)
+	}
+}
+
+func TestDataSegmentWritable(t *testing.T) {
+	// store #1, 0x100 ; store #2, 42 ; poke #2, #1 ; peek #3, #1 ; exit
+	prog := []byte{
+		0x01, 0x01, 0x00, 0x01,
+		0x01, 0x02, 0x2A, 0x00,
+		0x61, 0x02, 0x01,
+		0x60, 0x03, 0x01,
+		0x00,
+	}
+
+	c := NewCPU()
+	c.LoadBytes(prog, 0)
+	if err := c.Run(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	if c.regs[3].GetInt() != 42 {
+		t.Fatalf("expected 42, got %d", c.regs[3].GetInt())
+	}
+}
+
+func TestStackOrder(t *testing.T) {
+	c := NewCPU()
+	c.stack.Push(1)
+	c.stack.Push(2)
+	if c.stack.Pop() != 2 || c.stack.Pop() != 1 || !c.stack.Empty() {
+		t.Fatalf("stack is not last-in, first-out")
+	}
+}
+
+func TestJumpRegisterToDataFaults(t *testing.T) {
+	// store #1, 0x4000 ; jmp #1
+	prog := []byte{
+		0x01, 0x01, 0x00, 0x40,
+		0x13, 0x01,
+	}
+
+	c := NewCPU()
+	c.LoadBytes(prog, 0)
+	err := c.Run()
+
+	var fault *MemoryFault
+	if !errors.As(err, &fault) {
+		t.Fatalf("expected a memory fault, got %v", err)
+	}
+	if fault.Addr != 0x4000 || fault.IP != 4 || fault.Access != PermExec || fault.Segment != "data" {
+		t.Fatalf("unexpected fault %+v", fault)
+	}
+}
+
+func TestNegativeAddressFaults(t *testing.T) {
+	// store #1, 0 ; dec #1 ; peek #2, #1 ; exit
+	prog := []byte{
+		0x01, 0x01, 0x00, 0x00,
+		0x26, 0x01,
+		0x60, 0x02, 0x01,
+		0x00,
+	}
+
+	c := NewCPU()
+	c.LoadBytes(prog, 0)
+	err := c.Run()
+
+	var fault *MemoryFault
+	if !errors.As(err, &fault) || fault.Addr != -1 {
+		t.Fatalf("expected a memory fault at -1, got %v", err)
+	}
+	expected := "memory fault: read of unmapped address -0001 at IP 0006"
+	if err.Error() != expected {
+		t.Fatalf("expected %q, got %q", expected, err.Error())
+	}
+}
+
+func TestPokeDataSection(t *testing.T) {
+	e := compiler.New(lexer.New(`
+	store #1, buffer + 2
+	store #2, 65
+	poke #2, #1
+	store #1, end
+	poke #2, #1
+	exit
+
+	.data
+:buffer
+	.space 16
+:end
+	.byte 0
+`))
+	e.Compile()
+	prog := e.Program()
+	if len(prog.Data) != 17 {
+		t.Fatalf("expected 17 bytes of data, got %d", len(prog.Data))
+	}
+
+	c := NewCPU()
+	c.LoadProgram(prog)
+	if err := c.Run(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+	buffer := len(prog.Code)
+	if c.mem[buffer+2] != 65 || c.mem[buffer+16] != 65 {
+		t.Fatalf("expected writes to the buffer, got % X", c.mem[buffer:buffer+17])
+	}
+}
+
+func TestLoadDataSection(t *testing.T) {
+	e := compiler.New(lexer.New(`
+	store #1, count
+	peek #2, #1
+	inc #2
+	poke #2, #1
+	exit
+
+	.data
+:greeting
+	.asciz "hi"
+:count
+	.byte 41
+`))
+	e.Compile()
+
+	c := NewCPU()
+	c.LoadBytes(e.Program().Encode(), 0)
+	if err := c.Run(); err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	data := c.segment("code").End
+	if got := string(c.mem[data : data+4]); got != "hi\x00*" {
+		t.Fatalf("expected the data after the code, got %q", got)
+	}
+}
+
+func TestStringMemory(t *testing.T) {
+	tests := []struct {
+		src      string
+		expected string
+	}{
+		{`
+	store #1, "hello"
+	store #2, buffer
+	strstore #1, #2
+	store #3, 4
+	strload #1, #2, #3
+	exit
+	.data
+:buffer
+	.space 8
+`, "hell"},
+		{`
+	store #1, "hello"
+	store #2, buffer
+	strstorep #1, #2
+	strloadp #1, #2
+	exit
+	.data
+:buffer
+	.space 8
+`, "hello"},
+		{`
+	store #1, buffer
+	store #3, 0
+	strload #1, #1, #3
+	exit
+	.data
+:buffer
+	.byte 0
+`, ""},
+		{`
+	store #1, 65
+	chr #1
+	exit
+`, "A"},
+	}
+	for i, tt := range tests {
+		c, err := run(t, tt.src)
+		if err != nil {
+			t.Errorf("tests[%d]: unexpected error %s", i, err)
+			continue
+		}
+		if got := c.regs[1].GetString(); got != tt.expected {
+			t.Errorf("tests[%d]: expected %q, got %q", i, tt.expected, got)
+		}
+	}
+
+	c, err := run(t, `
+	store #1, "A"
+	ord #1
+	exit
+`)
+	if err != nil || c.regs[1].GetInt() != 65 {
+		t.Errorf("expected ord to give 65, got %v", err)
+	}
+}
+
+func TestStringNegativeLength(t *testing.T) {
+	_, err := run(t, `
+	store #2, buffer
+	store #3, 0
+	dec #3
+	strload #1, #2, #3
+	exit
+	.data
+:buffer
+	.byte 0
+`)
+	var fault *OperandFault
+	if !errors.As(err, &fault) {
+		t.Fatalf("expected an operand fault, got %v", err)
+	}
+	expected := "operand fault: negative length -1 at IP 000A"
+	if err.Error() != expected {
+		t.Fatalf("expected %q, got %q", expected, err.Error())
+	}
+}
@@ -0,0 +1,129 @@
+package cpu
+
+import (
+	"fmt"
+	"strings"
+
+	"gosc-vm/opcode"
+)
+
+// PrintMode controls how the `print_int` instruction shows integers.
+type PrintMode int
+
+// The available print modes.
+const (
+	// PrintHex shows integers as two, or four, hex digits.
+	PrintHex PrintMode = iota
+	// PrintDecimal shows integers in decimal.
+	PrintDecimal
+	// PrintBinary shows integers in binary.
+	PrintBinary
+)
+
+// ParsePrintMode converts a mode-name, such as "decimal", to a PrintMode.
+// The names are those accepted by the `print_mode` instruction.
+func ParsePrintMode(name string) (PrintMode, bool) {
+	ins, _ := opcode.Lookup(opcode.PRINT_MODE)
+	mode, ok := ins.Values[strings.ToLower(name)]
+	return PrintMode(mode), ok
+}
+
+// SetPrintMode sets the way in which `print_int` shows integers.
+func (c *CPU) SetPrintMode(mode PrintMode) {
+	c.printMode = mode
+}
+
+// formatInt formats an integer for `print_int`, according to our mode.
+func (c *CPU) formatInt(val int) string {
+	switch c.printMode {
+	case PrintDecimal:
+		return fmt.Sprintf("%d", val)
+	case PrintBinary:
+		return fmt.Sprintf("%b", val)
+	}
+	if val < 256 {
+		return fmt.Sprintf("%02X", val)
+	}
+	return fmt.Sprintf("%04X", val)
+}
+
+// sprintf formats the given registers according to the format string,
+// for the `printf` instruction.
+//
+// The supported verbs are %d, %x, %X, %b, %s, %c, %f, %e, %g, and %%.
+// Each verb may be preceded by a "-" flag to left-justify, a "0" flag to
+// pad with zeros, a width, and a precision such as ".2".
+func (c *CPU) sprintf(format string, regs []byte) string {
+	var out strings.Builder
+
+	str := []rune(format)
+	arg := 0
+	for i := 0; i < len(str); i++ {
+		if str[i] != '%' {
+			out.WriteRune(str[i])
+			continue
+		}
+
+		// Collect the flags and width.
+		spec := "%"
+		i++
+		for i < len(str) && strings.ContainsRune("-.0123456789", str[i]) {
+			spec += string(str[i])
+			i++
+		}
+		if i >= len(str) {
+			out.WriteString(spec)
+			break
+		}
+
+		verb := str[i]
+		if verb == '%' {
+			out.WriteRune('%')
+			continue
+		}
+		if !strings.ContainsRune("dxXbscfeg", verb) {
+			out.WriteString(spec + string(verb))
+			continue
+		}
+		if arg >= len(regs) {
+			out.WriteString(fmt.Sprintf("%%!%c(MISSING)", verb))
+			continue
+		}
+
+		reg := c.register(int(regs[arg]))
+		arg++
+
+		switch verb {
+		case 's':
+			switch reg.Type() {
+			case "big":
+				out.WriteString(fmt.Sprintf(spec+"s", reg.GetBig()))
+			case "string":
+				out.WriteString(fmt.Sprintf(spec+"s", reg.GetString()))
+			case "float":
+				out.WriteString(fmt.Sprintf(spec+"v", reg.GetFloat()))
+			default:
+				out.WriteString(fmt.Sprintf(spec+"d", reg.GetInt()))
+			}
+		case 'f', 'e', 'g':
+			if reg.Type() == "float" {
+				out.WriteString(fmt.Sprintf(spec+string(verb), reg.GetFloat()))
+			} else {
+				out.WriteString(fmt.Sprintf(spec+string(verb), float64(reg.GetInt())))
+			}
+		case 'c':
+			if reg.Type() == "string" {
+				out.WriteString(fmt.Sprintf(spec+"s", reg.GetString()))
+			} else {
+				out.WriteString(fmt.Sprintf(spec+"c", rune(reg.GetInt())))
+			}
+		default:
+			if reg.Type() == "big" {
+				out.WriteString(fmt.Sprintf(spec+string(verb), reg.GetBig()))
+			} else {
+				out.WriteString(fmt.Sprintf(spec+string(verb), reg.GetInt()))
+			}
+		}
+	}
+	return out.String()
+}
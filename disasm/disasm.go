@@ -0,0 +1,360 @@
+// Package disasm converts bytecode back into assembly.
+//
+// The output can be given to the compiler again, to produce identical
+// bytecode: jump and call targets are given labels, and anything which
+// cannot be decoded as an instruction is shown as `DB` data.  Jumps and
+// calls with absolute addresses are preceded by the `.absolute` directive,
+// as the compiler otherwise prefers relative ones.
+package disasm
+
+import (
+	"fmt"
+	"math"
+	"sort"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
+
+	"gosc-vm/binfmt"
+	"gosc-vm/opcode"
+)
+
+// maxShown is the number of raw bytes shown for each line.
+const maxShown = 8
+
+// Line is a single line of disassembly.
+type Line struct {
+	// Addr is the address of the first byte.
+	Addr int
+	// Bytes holds the raw bytes.
+	Bytes []byte
+	// Label is the name of the label at this address, if any.
+	Label string
+	// Asm is the assembly, e.g. `store #1, "hello"`.
+	Asm string
+
+	// decoded is the instruction, if this isn't data.
+	decoded *opcode.Decoded
+}
+
+// Disassemble decodes the given bytecode.
+func Disassemble(code []byte) []Line {
+	return disassemble(&binfmt.Program{Code: code, Movable: true})
+}
+
+// DisassembleProgram decodes the given program, using the names from its
+// symbol table for labels.  Its data section follows the code, as `DB`
+// lines after a `.data` directive, and an entry point other than the
+// start is given by an `.entry` directive.
+func DisassembleProgram(prog *binfmt.Program) []Line {
+	return disassemble(prog)
+}
+
+// disassemble decodes the given program.
+func disassemble(prog *binfmt.Program) []Line {
+	code := prog.Code
+	var lines []Line
+
+	addr := 0
+	for addr < len(code) {
+		// Decode the instruction, noting if it runs off the end.
+		truncated := false
+		fetch := func(a int) byte {
+			if a >= len(code) {
+				truncated = true
+				return 0
+			}
+			return code[a]
+		}
+		d, ok := opcode.Decode(fetch, addr)
+		if !ok || truncated {
+			lines = append(lines, Line{Addr: addr, Bytes: code[addr : addr+1]})
+			addr++
+			continue
+		}
+		lines = append(lines, Line{Addr: addr, Bytes: code[addr : addr+d.Length], decoded: &d})
+		addr += d.Length
+	}
+
+	// Jump and call targets get labels, so long as they are the start
+	// of a line, or the end of the code.  Symbols may also name any
+	// byte of the data section, or its end.
+	starts := make(map[int]bool)
+	for _, l := range lines {
+		starts[l.Addr] = true
+	}
+	starts[len(code)] = true
+	for i := range prog.Data {
+		starts[len(code)+i+1] = true
+	}
+
+	labels := make(map[int]string)
+	for _, sym := range prog.Symbols {
+		// names such as "@1.2", which the compiler generates,
+		// can't be written
+		if _, ok := labels[sym.Addr]; starts[sym.Addr] && !ok && !strings.Contains(sym.Name, "@") {
+			labels[sym.Addr] = sym.Name
+		}
+	}
+	if _, ok := labels[prog.Entry]; prog.Entry != 0 && starts[prog.Entry] && !ok {
+		labels[prog.Entry] = fmt.Sprintf("label_%04X", prog.Entry)
+	}
+	for _, l := range lines {
+		if l.decoded == nil {
+			continue
+		}
+		for i, kind := range l.decoded.Operands {
+			target := l.decoded.Args[i].Int
+			if _, ok := labels[target]; (kind == opcode.Addr || kind == opcode.Rel) && starts[target] && !ok {
+				labels[target] = fmt.Sprintf("label_%04X", target)
+			}
+		}
+	}
+
+	// Values are only the addresses of labels if the program can't be
+	// loaded elsewhere, as it holds those addresses.
+	values := labels
+	if prog.Movable {
+		values = nil
+	}
+	for i := range lines {
+		lines[i].Label = labels[lines[i].Addr]
+		lines[i].Asm = format(lines[i], labels, values)
+	}
+	lines = modes(merge(lines))
+
+	// The data section follows the code, so begins with any label
+	// at its end.
+	if len(prog.Data) > 0 {
+		lines = append(lines, Line{Addr: len(code), Asm: ".data"})
+	}
+	var data []Line
+	for i, b := range prog.Data {
+		a := len(code) + i
+		data = append(data, Line{Addr: a, Bytes: prog.Data[i : i+1], Label: labels[a], Asm: dataAsm([]byte{b})})
+	}
+	lines = append(lines, merge(data)...)
+
+	// A label might refer to the end of the program.
+	end := len(code) + len(prog.Data)
+	if name, ok := labels[end]; ok {
+		lines = append(lines, Line{Addr: end, Label: name})
+	}
+
+	if name, ok := labels[prog.Entry]; ok && prog.Entry != 0 {
+		lines = append(lines, Line{Addr: prog.Entry, Asm: ".entry " + name})
+	}
+	return lines
+}
+
+// modes inserts the `.absolute` and `.relative` directives needed for the
+// compiler to choose the encodings of jumps and calls we've found.
+func modes(lines []Line) []Line {
+	var out []Line
+	absolute := false
+	for _, l := range lines {
+		if l.decoded != nil {
+			for _, kind := range l.decoded.Operands {
+				if kind != opcode.Addr && kind != opcode.Rel {
+					continue
+				}
+				if want := kind == opcode.Addr; want != absolute {
+					absolute = want
+					dir := ".relative"
+					if absolute {
+						dir = ".absolute"
+					}
+					out = append(out, Line{Addr: l.Addr, Asm: dir})
+				}
+			}
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+// merge combines adjacent lines of data, which have no label between
+// them, into a single `DB` line.
+func merge(lines []Line) []Line {
+	var out []Line
+	for _, l := range lines {
+		if len(out) > 0 {
+			prev := &out[len(out)-1]
+			if prev.decoded == nil && l.decoded == nil && l.Label == "" &&
+				len(prev.Bytes) > 0 && len(l.Bytes) > 0 && len(prev.Bytes) < maxShown {
+				prev.Bytes = append(prev.Bytes[:len(prev.Bytes):len(prev.Bytes)], l.Bytes...)
+				prev.Asm = dataAsm(prev.Bytes)
+				continue
+			}
+		}
+		out = append(out, l)
+	}
+	return out
+}
+
+// format returns the assembly for the given line, with the names of the
+// given labels for its targets, and of the given values for its integers.
+func format(l Line, labels map[int]string, values map[int]string) string {
+	d := l.decoded
+	if d == nil {
+		return dataAsm(l.Bytes)
+	}
+
+	var ops []string
+	for i, kind := range d.Operands {
+		arg := d.Args[i]
+		switch kind {
+		case opcode.Reg:
+			if arg.Int >= opcode.Registers {
+				// our assembly can't express this register
+				return dataAsm(l.Bytes)
+			}
+			ops = append(ops, fmt.Sprintf("#%d", arg.Int))
+		case opcode.Imm16:
+			if name, ok := values[arg.Int]; ok {
+				ops = append(ops, name)
+			} else {
+				ops = append(ops, fmt.Sprintf("%d", arg.Int))
+			}
+		case opcode.Addr, opcode.Rel:
+			if name, ok := labels[arg.Int]; ok {
+				ops = append(ops, name)
+			} else if arg.Int < 0 {
+				// a relative target before the start of the code
+				ops = append(ops, fmt.Sprintf("%d", arg.Int))
+			} else {
+				ops = append(ops, fmt.Sprintf("0x%04X", arg.Int))
+			}
+		case opcode.Byte:
+			ops = append(ops, valueName(d.Instruction, arg.Int))
+		case opcode.Str:
+			ops = append(ops, quote(arg.Str))
+		case opcode.Float:
+			str, ok := floatLiteral(arg.Float)
+			if !ok {
+				// our assembly can't express this value
+				return dataAsm(l.Bytes)
+			}
+			ops = append(ops, str)
+		case opcode.RegList:
+			for _, r := range arg.Regs {
+				if r >= opcode.Registers {
+					return dataAsm(l.Bytes)
+				}
+				ops = append(ops, fmt.Sprintf("#%d", r))
+			}
+		}
+	}
+	if len(ops) == 0 {
+		return d.Mnemonic
+	}
+	return d.Mnemonic + " " + strings.Join(ops, ", ")
+}
+
+// dataAsm returns a `DB` line holding the given bytes.
+func dataAsm(data []byte) string {
+	var out []string
+	for _, b := range data {
+		out = append(out, fmt.Sprintf("0x%02X", b))
+	}
+	return "DB " + strings.Join(out, ", ")
+}
+
+// valueName returns the shortest name for a byte operand, such as the
+// mode of `print_mode`, falling back to the number.
+func valueName(ins *opcode.Instruction, val int) string {
+	var names []string
+	for name, v := range ins.Values {
+		if v == val {
+			names = append(names, name)
+		}
+	}
+	if len(names) == 0 {
+		return fmt.Sprintf("%d", val)
+	}
+	sort.Slice(names, func(i, j int) bool {
+		if len(names[i]) != len(names[j]) {
+			return len(names[i]) < len(names[j])
+		}
+		return names[i] < names[j]
+	})
+	return names[0]
+}
+
+// quote returns a string literal which our lexer will read back as the
+// given bytes.  Text which isn't printable UTF-8 is escaped as `\xHH`.
+func quote(str string) string {
+	var out strings.Builder
+	out.WriteByte('"')
+	for i := 0; i < len(str); {
+		r, size := utf8.DecodeRuneInString(str[i:])
+		switch {
+		case r == '"' || r == '\\':
+			out.WriteByte('\\')
+			out.WriteRune(r)
+		case r == '\n':
+			out.WriteString(`\n`)
+		case r == '\r':
+			out.WriteString(`\r`)
+		case r == '\t':
+			out.WriteString(`\t`)
+		case r == utf8.RuneError || !unicode.IsPrint(r):
+			for _, b := range []byte(str[i : i+size]) {
+				fmt.Fprintf(&out, `\x%02X`, b)
+			}
+		default:
+			out.WriteRune(r)
+		}
+		i += size
+	}
+	out.WriteByte('"')
+	return out.String()
+}
+
+// floatLiteral returns the given number in a form our compiler will read
+// back exactly, i.e. with a decimal point.  Our assembly has no way of
+// writing infinities, or NaNs.
+func floatLiteral(f float64) (string, bool) {
+	if math.IsInf(f, 0) || math.IsNaN(f) {
+		return "", false
+	}
+	str := strconv.FormatFloat(f, 'g', -1, 64)
+	if !strings.Contains(str, ".") {
+		if i := strings.Index(str, "e"); i >= 0 {
+			str = str[:i] + ".0" + str[i:]
+		} else {
+			str += ".0"
+		}
+	}
+	return str, true
+}
+
+// Format returns the lines as assembly, with the address and raw bytes
+// of each line shown in a trailing comment.
+func Format(lines []Line) string {
+	var out strings.Builder
+	for _, l := range lines {
+		if l.Label != "" {
+			fmt.Fprintf(&out, ":%s\n", l.Label)
+		}
+		if len(l.Bytes) == 0 {
+			if l.Asm != "" {
+				// a directive
+				fmt.Fprintf(&out, "\t%s\n", l.Asm)
+			}
+			continue
+		}
+
+		var raw []string
+		for i, b := range l.Bytes {
+			if i == maxShown {
+				raw = append(raw, "...")
+				break
+			}
+			raw = append(raw, fmt.Sprintf("%02X", b))
+		}
+		fmt.Fprintf(&out, "\t%-40s # %04X: %s\n", l.Asm, l.Addr, strings.Join(raw, " "))
+	}
+	return out.String()
+}
@@ -0,0 +1,131 @@
+package disasm
+
+import (
+	"bytes"
+	"math/rand"
+	"strings"
+	"testing"
+
+	"gosc-vm/compiler"
+	"gosc-vm/lexer"
+)
+
+// compile compiles the given assembly.
+func compile(src string) []byte {
+	c := compiler.New(lexer.New(src))
+	c.Compile()
+	return c.Output()
+}
+
+// roundTrip ensures that disassembling, and compiling, the given bytecode
+// gives it back unchanged.
+func roundTrip(t *testing.T, code []byte) string {
+	t.Helper()
+	asm := Format(Disassemble(code))
+	out := compile(asm)
+	if !bytes.Equal(code, out) {
+		t.Fatalf("round-trip failed:\n% X\n% X\n%s", code, out, asm)
+	}
+	return asm
+}
+
+// roundTripProgram ensures that disassembling, and compiling, the program
+// compiled from the given assembly gives it back unchanged, but for its
+// source-lines.
+func roundTripProgram(t *testing.T, src string) string {
+	t.Helper()
+	c := compiler.New(lexer.New(src))
+	c.Compile()
+	prog := c.Program()
+
+	asm := Format(DisassembleProgram(prog))
+	c = compiler.New(lexer.New(asm))
+	c.Compile()
+	out := c.Program()
+
+	// the source-lines differ, of course
+	prog.Lines, out.Lines = nil, nil
+	if !bytes.Equal(prog.Encode(), out.Encode()) {
+		t.Fatalf("round-trip failed:\n%+v\n%+v\n%s", prog, out, asm)
+	}
+	return asm
+}
+
+func TestRoundTrip(t *testing.T) {
+	src := `
+:start
+	print_mode dec
+	store #1, "héllo \"world\"\n\x01\xff"
+	store #2, 2.5
+	store #3, 1.0e+21
+	store #7, -0.125
+	store #4, 0x1234
+	store #5, #4
+	store #6, sub
+	cmp #1, "hi"
+	printf #1, #2, #3
+	add #1, #1, 3
+	call sub
+	jmpz start
+	jmp end
+:sub
+	ret
+:end
+	exit
+	DB 0xFF, 0x21, 0x01
+`
+	asm := roundTrip(t, compile(src))
+
+	for _, want := range []string{"call label_", "jmpz label_0000", `"héllo \"world\"\n\x01\xFF"`, "print_mode dec", "DB 0xFF"} {
+		if !strings.Contains(asm, want) {
+			t.Errorf("disassembly lacks %q:\n%s", want, asm)
+		}
+	}
+
+	// The symbols of a program name its labels, and the values which
+	// are their addresses.
+	asm = roundTripProgram(t, src)
+	for _, want := range []string{"call sub", "store #6, sub", "jmpz start"} {
+		if !strings.Contains(asm, want) {
+			t.Errorf("disassembly lacks %q:\n%s", want, asm)
+		}
+	}
+}
+
+// TestProgram ensures that a program's data section, and entry point,
+// survive a round-trip.
+func TestProgram(t *testing.T) {
+	src := `
+:sub
+	store #1, greeting
+	ret
+:main
+	call sub
+	store #2, 3
+	exit
+
+	.data
+:greeting
+	.asciz "hi"
+:count
+	.word 0x1234
+:end
+	.entry main
+`
+	asm := roundTripProgram(t, src)
+	for _, want := range []string{"store #1, greeting", "\t.data\n:greeting\n", ":count\n", ":end\n", ".entry main"} {
+		if !strings.Contains(asm, want) {
+			t.Errorf("disassembly lacks %q:\n%s", want, asm)
+		}
+	}
+}
+
+// TestRandom ensures that arbitrary bytes survive a round-trip.
+func TestRandom(t *testing.T) {
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 200; i++ {
+		code := make([]byte, r.Intn(64))
+		r.Read(code)
+		roundTrip(t, code)
+	}
+}
@@ -0,0 +1,131 @@
+// Package include implements the ".include" directive, which reads the
+// tokens of another source file in its place.
+//
+// A relative path is looked for beside the file which includes it, and
+// then in each directory of the search path in turn.  Each file is read
+// only once, so needs no include guard, and a file which includes itself,
+// directly or otherwise, is reported as an error.
+package include
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"gosc-vm/lexer"
+	"gosc-vm/token"
+)
+
+// Reader reads tokens from a file, and those which it includes.
+type Reader struct {
+	dirs  []string        // the search path
+	stack []*lexer.Lexer  // the files being read, innermost last
+	paths []string        // their absolute paths, for finding cycles
+	seen  map[string]bool // the absolute paths of every file read
+	raw   bool            // true to return .include as a token
+}
+
+// New returns a reader of the tokens from the given lexer.
+func New(l *lexer.Lexer) *Reader {
+	r := &Reader{stack: []*lexer.Lexer{l}, seen: make(map[string]bool)}
+
+	path := ""
+	if l.File() != "" {
+		path, _ = filepath.Abs(l.File())
+		r.seen[path] = true
+	}
+	r.paths = []string{path}
+	return r
+}
+
+// SetPath sets the directories searched for included files.
+func (r *Reader) SetPath(dirs []string) {
+	r.dirs = dirs
+}
+
+// SetRaw sets whether .include directives are returned as tokens, with
+// the name which follows, rather than acted upon, as when skipping code
+// which isn't assembled.  Any which are to be acted upon after all are
+// given to Include.
+func (r *Reader) SetRaw(raw bool) {
+	r.raw = raw
+}
+
+// NextToken returns the next token, from whichever file is being read.
+func (r *Reader) NextToken() token.Token {
+	for {
+		l := r.stack[len(r.stack)-1]
+		tok := l.NextToken()
+
+		switch {
+		case tok.Type == token.EOF && len(r.stack) > 1:
+			// continue with the file which included this one
+			r.stack = r.stack[:len(r.stack)-1]
+			r.paths = r.paths[:len(r.paths)-1]
+		case tok.Type == token.DIRECTIVE && tok.Literal == ".include" && !r.raw:
+			r.Include(tok, l.NextToken())
+		default:
+			return tok
+		}
+	}
+}
+
+// Include starts reading the file named by the given token.
+func (r *Reader) Include(dir token.Token, name token.Token) {
+	if name.Type != token.STRING {
+		fail(dir, "expected the name of a file to include, got '%s'", name.Literal)
+	}
+
+	file := r.find(dir, name.Literal)
+	path, err := filepath.Abs(file)
+	if err != nil {
+		fail(name, "cannot include %s - %s", file, err.Error())
+	}
+
+	for i, p := range r.paths {
+		if p == path {
+			var cycle []string
+			for _, l := range r.stack[i:] {
+				cycle = append(cycle, l.File())
+			}
+			fail(name, "include cycle: %s -> %s", strings.Join(cycle, " -> "), file)
+		}
+	}
+	if r.seen[path] {
+		return
+	}
+	r.seen[path] = true
+
+	input, err := ioutil.ReadFile(file)
+	if err != nil {
+		fail(name, "cannot include %s - %s", file, err.Error())
+	}
+	r.stack = append(r.stack, lexer.NewFile(file, string(input)))
+	r.paths = append(r.paths, path)
+}
+
+// find returns the path of the named file, as included from the given
+// token.
+func (r *Reader) find(dir token.Token, name string) string {
+	if filepath.IsAbs(name) {
+		return name
+	}
+
+	dirs := append([]string{filepath.Dir(dir.File)}, r.dirs...)
+	for _, d := range dirs {
+		path := filepath.Join(d, name)
+		if _, err := os.Stat(path); err == nil {
+			return path
+		}
+	}
+	fail(dir, "cannot find %s to include, in %s", name, strings.Join(dirs, ", "))
+	return ""
+}
+
+// fail reports an error at the given token, and exits.
+func fail(tok token.Token, format string, args ...interface{}) {
+	fmt.Printf("ERROR: %s: %s\n", tok.Location(), fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
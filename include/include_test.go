@@ -0,0 +1,55 @@
+package include
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"gosc-vm/lexer"
+	"gosc-vm/token"
+)
+
+func TestInclude(t *testing.T) {
+	dir, err := ioutil.TempDir("", "include")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(dir)
+
+	files := map[string]string{
+		"main.in":        ".include \"a.in\"\n.include \"lib.in\"\nexit\n",
+		"a.in":           "\n.include \"lib.in\"\nnop\n",
+		"path/lib.in":    "ret\n",
+		"other/lib.in":   "halt\n",
+		"path/unused.in": "unused\n",
+	}
+	for name, src := range files {
+		path := filepath.Join(dir, name)
+		os.MkdirAll(filepath.Dir(path), 0755)
+		if err := ioutil.WriteFile(path, []byte(src), 0644); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	main := filepath.Join(dir, "main.in")
+	r := New(lexer.NewFile(main, files["main.in"]))
+	r.SetPath([]string{filepath.Join(dir, "path"), filepath.Join(dir, "other")})
+
+	var got []string
+	for {
+		tok := r.NextToken()
+		if tok.Type == token.EOF {
+			break
+		}
+		got = append(got, fmt.Sprintf("%s:%d:%s", filepath.Base(tok.File), tok.Line, tok.Literal))
+	}
+
+	// lib.in is only included once, from the search path.
+	expected := "lib.in:1:ret a.in:3:nop main.in:3:exit"
+	if strings.Join(got, " ") != expected {
+		t.Fatalf("expected %q, got %q", expected, strings.Join(got, " "))
+	}
+}
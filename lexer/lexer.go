@@ -1,6 +1,12 @@
 package lexer
 
-import "gosc-vm/token"
+import (
+	"strconv"
+	"strings"
+	"unicode/utf8"
+
+	"gosc-vm/token"
+)
 
 // Lexer is used as a lexer for our VM
 type Lexer struct {
@@ -8,17 +14,33 @@ type Lexer struct {
 	readPosition int    //next charactor position
 	ch           rune   //current charactor
 	characters   []rune //rune slice of input string
+	line         int    //line of the current character
+	file         string //name of the file being read, if any
 }
 
 // New a Lexer instance from string input
 func New(input string) *Lexer {
-	l := &Lexer{characters: []rune(input)}
+	return NewFile("", input)
+}
+
+// NewFile returns a Lexer reading the contents of the named file, whose
+// name is recorded in each token for diagnostics.
+func NewFile(file string, input string) *Lexer {
+	l := &Lexer{characters: []rune(input), line: 1, file: file}
 	l.readChar()
 	return l
 }
 
+// File returns the name of the file being read, if any.
+func (l *Lexer) File() string {
+	return l.file
+}
+
 // Read one forward character
 func (l *Lexer) readChar() {
+	if l.ch == rune('\n') {
+		l.line++
+	}
 	if l.readPosition >= len(l.characters) {
 		l.ch = rune(0)
 	} else {
@@ -30,28 +52,38 @@ func (l *Lexer) readChar() {
 
 // NextToken is read next token, skipping the white space.
 func (l *Lexer) NextToken() token.Token {
-	var tok token.Token
 	l.skipWhiteSpace()
 
 	// skip single-line comments
 	// unless they are immediately followed by a number,
 	// because our registers are "#N".
-	if l.ch == rune('#') {
-		if !isDigit(l.peekChar()) {
-			l.skipComment()
-			return (l.NextToken())
-		}
+	for l.ch == rune('#') && !isDigit(l.peekChar()) {
+		l.skipComment()
 	}
 
+	line := l.line
+	tok := l.readToken()
+	tok.File = l.file
+	tok.Line = line
+	return tok
+}
+
+// readToken reads the token at the current position.
+func (l *Lexer) readToken() token.Token {
+	var tok token.Token
+
 	switch l.ch {
 	case rune(','):
 		tok = newToken(token.COMMA, l.ch)
+	case rune('+'), rune('-'), rune('*'), rune('/'), rune('('), rune(')'):
+		tok = newToken(token.TokenType(string(l.ch)), l.ch)
+	case rune('='), rune('<'), rune('>'), rune('!'):
+		tok = l.readComparison()
 	case rune('"'):
 		tok.Type = token.STRING
 		tok.Literal = l.readString()
 	case rune(':'):
-		tok.Type = token.LABEL
-		tok.Literal = l.readLabel()
+		tok = l.readLabel()
 	case rune(0):
 		tok.Type = token.EOF
 		tok.Literal = ""
@@ -103,7 +135,7 @@ func (l *Lexer) readNumber() string {
 
 func (l *Lexer) readUntilWhitespace() string {
 	pos := l.position
-	for !isWhitespace(l.ch) {
+	for !isWhitespace(l.ch) && !isEmpty(l.ch) {
 		l.readChar()
 	}
 	return string(l.characters[pos:l.position])
@@ -112,47 +144,130 @@ func (l *Lexer) readUntilWhitespace() string {
 func (l *Lexer) readDecimal() token.Token {
 	integer := l.readNumber()
 
-	if isEmpty(l.ch) || isWhitespace(l.ch) || l.ch == rune(',') {
+	if isEmpty(l.ch) || isWhitespace(l.ch) || l.ch == rune(',') || isOperator(l.ch) {
+		if isLabelReference(integer) {
+			return token.Token{Type: token.IDENT, Literal: integer}
+		}
 		return token.Token{Type: token.INT, Literal: integer}
 	}
+	if l.ch == rune('.') && isDigit(l.peekChar()) {
+		return l.readFloat(integer)
+	}
 	illegalPart := l.readUntilWhitespace()
 	return token.Token{Type: token.ILLEGAL, Literal: integer + illegalPart}
 }
 
+// readFloat reads the fractional part, and optional exponent, of a
+// floating-point number whose integer part has already been read.
+func (l *Lexer) readFloat(integer string) token.Token {
+	pos := l.position
+
+	// skip the "."
+	l.readChar()
+	for isDigit(l.ch) {
+		l.readChar()
+	}
+
+	// optional exponent
+	if l.ch == rune('e') || l.ch == rune('E') {
+		l.readChar()
+		if l.ch == rune('+') || l.ch == rune('-') {
+			l.readChar()
+		}
+		for isDigit(l.ch) {
+			l.readChar()
+		}
+	}
+	number := integer + string(l.characters[pos:l.position])
+
+	if isEmpty(l.ch) || isWhitespace(l.ch) || l.ch == rune(',') {
+		return token.Token{Type: token.FLOAT, Literal: number}
+	}
+	illegalPart := l.readUntilWhitespace()
+	return token.Token{Type: token.ILLEGAL, Literal: number + illegalPart}
+}
+
+// readString reads a string literal, handling escapes.  The result is
+// UTF-8, except where raw bytes have been inserted via `\xHH`.
 func (l *Lexer) readString() string {
-	out := ""
+	var out []byte
 
 	for {
 		l.readChar()
-		if l.ch == '"' {
+		if l.ch == '"' || isEmpty(l.ch) {
 			break
 		}
-		// Handle \n, \r, \t, \", etc..
+		// Handle \n, \r, \t, \", \xHH, \uHHHH, etc..  The decoded
+		// character is kept apart from l.ch, lest a newline be
+		// counted as another line.
+		ch := l.ch
 		if l.ch == '\\' {
 			l.readChar()
-			if l.ch == rune('n') {
-				l.ch = '\n'
-			}
-			if l.ch == rune('r') {
-				l.ch = '\r'
-			}
-			if l.ch == rune('t') {
-				l.ch = '\t'
-			}
-			if l.ch == rune('"') {
-				l.ch = '"'
-			}
-			if l.ch == rune('\\') {
-				l.ch = '\\'
+			ch = l.ch
+			switch l.ch {
+			case rune('n'):
+				ch = '\n'
+			case rune('r'):
+				ch = '\r'
+			case rune('t'):
+				ch = '\t'
+			case rune('x'):
+				if val, ok := l.readHexEscape(2); ok {
+					out = append(out, byte(val))
+					continue
+				}
+			case rune('u'):
+				if val, ok := l.readHexEscape(4); ok {
+					out = utf8.AppendRune(out, rune(val))
+					continue
+				}
 			}
 		}
-		out = out + string(l.ch)
+		out = utf8.AppendRune(out, ch)
 	}
-	return out
+	return string(out)
 }
 
-func (l *Lexer) readLabel() string {
-	return l.readUntilWhitespace()
+// readHexEscape reads the given number of hex digits following an escape
+// such as `\x`.  If they are not present nothing is consumed.
+func (l *Lexer) readHexEscape(digits int) (int, bool) {
+	if l.readPosition+digits > len(l.characters) {
+		return 0, false
+	}
+	hex := string(l.characters[l.readPosition : l.readPosition+digits])
+	val, err := strconv.ParseUint(hex, 16, 32)
+	if err != nil {
+		return 0, false
+	}
+	for i := 0; i < digits; i++ {
+		l.readChar()
+	}
+	return int(val), true
+}
+
+// readComparison reads "=", or a comparison such as "<" or "<=".  A "!"
+// is only valid as part of "!=".
+func (l *Lexer) readComparison() token.Token {
+	ch := l.ch
+	if l.peekChar() == rune('=') {
+		l.readChar()
+		op := string(ch) + "="
+		return token.Token{Type: token.TokenType(op), Literal: op}
+	}
+	if ch == rune('!') {
+		return newToken(token.ILLEGAL, ch)
+	}
+	return newToken(token.TokenType(string(ch)), ch)
+}
+
+// readLabel reads the definition of a label.  A name holding a comma, or
+// an operator, is illegal, as a reference to it would end there.
+func (l *Lexer) readLabel() token.Token {
+	name := l.readUntilWhitespace()
+	if strings.IndexFunc(name, func(ch rune) bool { return !isIdentifier(ch) }) >= 0 {
+		return token.Token{Type: token.ILLEGAL, Literal: name}
+	}
+	return token.Token{Type: token.LABEL, Literal: name}
 }
 
 func (l *Lexer) peekChar() rune {
@@ -163,7 +278,26 @@ func (l *Lexer) peekChar() rune {
 }
 
 func isIdentifier(ch rune) bool {
-	return ch != rune(',') && !isWhitespace(ch) && !isEmpty(ch)
+	return ch != rune(',') && !isWhitespace(ch) && !isEmpty(ch) && !isOperator(ch)
+}
+
+// isOperator returns true for the characters of our integer expressions,
+// and "=", which end any identifier or number before them.
+func isOperator(ch rune) bool {
+	switch ch {
+	case rune('+'), rune('-'), rune('*'), rune('/'), rune('('), rune(')'):
+		return true
+	case rune('='), rune('<'), rune('>'), rune('!'):
+		return true
+	}
+	return false
+}
+
+// isLabelReference returns true for a reference to the nearest numeric
+// label before, or after, such as "1b" or "1f".
+func isLabelReference(s string) bool {
+	n := len(s) - 1
+	return n > 0 && (s[n] == 'b' || s[n] == 'f') && strings.Trim(s[:n], "0123456789") == ""
 }
 
 func isWhitespace(ch rune) bool {
@@ -42,24 +42,24 @@ func TestNextTokenReal(t *testing.T) {
 		expectedType    token.TokenType
 		expectedLiteral string
 	}{
-		{token.STORE, "store"},
+		{token.INSTRUCTION, "store"},
 		{token.IDENT, "#1"},
 		{token.COMMA, ","},
 		{token.INT, "10"},
 
-		{token.STORE, "store"},
+		{token.INSTRUCTION, "store"},
 		{token.IDENT, "#2"},
 		{token.COMMA, ","},
 		{token.INT, "20"},
 
-		{token.ADD, "add"},
+		{token.INSTRUCTION, "add"},
 		{token.IDENT, "#0"},
 		{token.COMMA, ","},
 		{token.IDENT, "#1"},
 		{token.COMMA, ","},
 		{token.IDENT, "#2"},
 
-		{token.PRINT_INT, "print_int"},
+		{token.INSTRUCTION, "print_int"},
 		{token.IDENT, "#0"},
 
 		{token.EOF, ""},
@@ -92,9 +92,9 @@ func TestSimpleComment(t *testing.T) {
 		expectedType    token.TokenType
 		expectedLiteral string
 	}{
-		{token.PRINT_INT, "print_int"},
+		{token.INSTRUCTION, "print_int"},
 		{token.IDENT, "#3"},
-		{token.PRINT_INT, "print_int"},
+		{token.INSTRUCTION, "print_int"},
 		{token.IDENT, "#21"},
 		{token.EOF, ""},
 	}
@@ -112,3 +112,225 @@ func TestSimpleComment(t *testing.T) {
 		}
 	}
 }
+
+func TestStringEscapes(t *testing.T) {
+	input := `store #1, "héllo"
+	store #2, "héllo\tworld\n"
+	store #3, "\x41\xe9"
+	store #4, "\q\x4"
+	`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.INSTRUCTION, "store"},
+		{token.IDENT, "#1"},
+		{token.COMMA, ","},
+		{token.STRING, "héllo"},
+		{token.INSTRUCTION, "store"},
+		{token.IDENT, "#2"},
+		{token.COMMA, ","},
+		{token.STRING, "héllo\tworld\n"},
+		{token.INSTRUCTION, "store"},
+		{token.IDENT, "#3"},
+		{token.COMMA, ","},
+		{token.STRING, "A\xe9"},
+		{token.INSTRUCTION, "store"},
+		{token.IDENT, "#4"},
+		{token.COMMA, ","},
+		{token.STRING, "qx4"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, but got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, but got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestFloat(t *testing.T) {
+	input := `store #1, 3.14
+	store #2, 1.5e-3
+	store #3, 2.5x
+	`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.INSTRUCTION, "store"},
+		{token.IDENT, "#1"},
+		{token.COMMA, ","},
+		{token.FLOAT, "3.14"},
+		{token.INSTRUCTION, "store"},
+		{token.IDENT, "#2"},
+		{token.COMMA, ","},
+		{token.FLOAT, "1.5e-3"},
+		{token.INSTRUCTION, "store"},
+		{token.IDENT, "#3"},
+		{token.COMMA, ","},
+		{token.ILLEGAL, "2.5x"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType {
+			t.Fatalf("tests[%d] - tokentype wrong, expected=%q, but got=%q",
+				i, tt.expectedType, tok.Type)
+		}
+		if tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - Literal wrong, expected=%q, but got=%q",
+				i, tt.expectedLiteral, tok.Literal)
+		}
+	}
+}
+
+func TestLineNumbers(t *testing.T) {
+	input := `store #1, "a
+b"
+# comment
+
+	store #2, "c\n"
+	exit`
+
+	tests := []struct {
+		expectedLiteral string
+		expectedLine    int
+	}{
+		{"store", 1},
+		{"#1", 1},
+		{",", 1},
+		{"a\nb", 1},
+		{"store", 5},
+		{"#2", 5},
+		{",", 5},
+		{"c\n", 5},
+		{"exit", 6},
+		{"", 6},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Literal != tt.expectedLiteral || tok.Line != tt.expectedLine {
+			t.Fatalf("tests[%d] - expected %q on line %d, but got %q on line %d",
+				i, tt.expectedLiteral, tt.expectedLine, tok.Literal, tok.Line)
+		}
+	}
+}
+
+func TestOperators(t *testing.T) {
+	input := `store #1, (BUFFER+0x10)*-2/x
+.if a==b!=c<d>e<=f>=g
+:end`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.INSTRUCTION, "store"},
+		{token.IDENT, "#1"},
+		{token.COMMA, ","},
+		{token.LPAREN, "("},
+		{token.IDENT, "BUFFER"},
+		{token.PLUS, "+"},
+		{token.INT, "0x10"},
+		{token.RPAREN, ")"},
+		{token.ASTERISK, "*"},
+		{token.MINUS, "-"},
+		{token.INT, "2"},
+		{token.SLASH, "/"},
+		{token.IDENT, "x"},
+		{token.DIRECTIVE, ".if"},
+		{token.IDENT, "a"},
+		{token.EQ, "=="},
+		{token.IDENT, "b"},
+		{token.NOT_EQ, "!="},
+		{token.IDENT, "c"},
+		{token.LT, "<"},
+		{token.IDENT, "d"},
+		{token.GT, ">"},
+		{token.IDENT, "e"},
+		{token.LT_EQ, "<="},
+		{token.IDENT, "f"},
+		{token.GT_EQ, ">="},
+		{token.IDENT, "g"},
+		{token.LABEL, ":end"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType || tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - expected %s %q, but got %s %q",
+				i, tt.expectedType, tt.expectedLiteral, tok.Type, tok.Literal)
+		}
+	}
+}
+
+func TestLabelReferences(t *testing.T) {
+	input := `:1 jmp 1b
+jmpz 12f, 0x1f, 1bc`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.LABEL, ":1"},
+		{token.INSTRUCTION, "jmp"},
+		{token.IDENT, "1b"},
+		{token.INSTRUCTION, "jmpz"},
+		{token.IDENT, "12f"},
+		{token.COMMA, ","},
+		{token.INT, "0x1f"},
+		{token.COMMA, ","},
+		{token.INT, "1bc"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType || tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - expected %s %q, but got %s %q",
+				i, tt.expectedType, tt.expectedLiteral, tok.Type, tok.Literal)
+		}
+	}
+}
+
+func TestLabelDefinitions(t *testing.T) {
+	input := `:.loop :@%%1 :my-label :a,b :x=1`
+
+	tests := []struct {
+		expectedType    token.TokenType
+		expectedLiteral string
+	}{
+		{token.LABEL, ":.loop"},
+		{token.LABEL, ":@%%1"},
+		{token.ILLEGAL, ":my-label"},
+		{token.ILLEGAL, ":a,b"},
+		{token.ILLEGAL, ":x=1"},
+		{token.EOF, ""},
+	}
+
+	l := New(input)
+	for i, tt := range tests {
+		tok := l.NextToken()
+		if tok.Type != tt.expectedType || tok.Literal != tt.expectedLiteral {
+			t.Fatalf("tests[%d] - expected %s %q, but got %s %q",
+				i, tt.expectedType, tt.expectedLiteral, tok.Type, tok.Literal)
+		}
+	}
+}
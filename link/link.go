@@ -0,0 +1,154 @@
+// Package link combines relocatable objects into a program.
+//
+// Each object given is included in the program, in order, while an
+// object from a library is only included if it exports a symbol which
+// is needed, and not yet defined.
+package link
+
+import (
+	"encoding/binary"
+	"fmt"
+	"sort"
+
+	"gosc-vm/binfmt"
+	"gosc-vm/opcode"
+)
+
+// Input is an object to be linked, along with the name of the file it
+// came from, for our error messages.
+type Input struct {
+	Name   string
+	Object *binfmt.Object
+}
+
+// placed is an object which has been included in our program.
+type placed struct {
+	Input
+	// base is the address at which the object's code is placed
+	base int
+	// local holds the addresses of all the object's symbols
+	local map[string]int
+}
+
+// definition records where a global symbol is defined.
+type definition struct {
+	obj  *placed
+	addr int
+}
+
+// Link combines the given objects, and any needed objects from the given
+// libraries, into a program starting at the named entry point, or at the
+// start of the first object if the entry is empty.
+//
+// Every problem found, such as duplicate or unresolved symbols, is
+// returned.
+func Link(objects []Input, libraries []Input, entry string) (*binfmt.Program, []error) {
+	var errs []error
+	var included []*placed
+	globals := make(map[string]definition)
+
+	include := func(in Input) {
+		p := &placed{Input: in, local: make(map[string]int)}
+		for _, s := range in.Object.Symbols {
+			p.local[s.Name] = s.Addr
+		}
+		for _, name := range in.Object.Exports {
+			if prev, ok := globals[name]; ok {
+				errs = append(errs, fmt.Errorf("duplicate symbol '%s' in %s, already defined in %s", name, in.Name, prev.obj.Name))
+				continue
+			}
+			globals[name] = definition{obj: p, addr: p.local[name]}
+		}
+		included = append(included, p)
+	}
+
+	for _, in := range objects {
+		include(in)
+	}
+
+	// Include library members until no more undefined symbols can be
+	// resolved by them.
+	used := make([]bool, len(libraries))
+	for changed := true; changed; {
+		changed = false
+		for i, lib := range libraries {
+			if used[i] || !providesNeeded(lib.Object, included, globals) {
+				continue
+			}
+			used[i] = true
+			changed = true
+			include(lib)
+		}
+	}
+
+	// Place each object after the previous one.
+	prog := &binfmt.Program{Version: binfmt.Version, Movable: true}
+	for _, p := range included {
+		p.base = len(prog.Code)
+		prog.Code = append(prog.Code, p.Object.Code...)
+		prog.Features |= p.Object.Features
+		prog.Movable = prog.Movable && p.Object.Movable
+		if len(p.Object.Data) > 0 {
+			errs = append(errs, fmt.Errorf("%s: objects may not contain data sections", p.Name))
+		}
+		for _, s := range p.Object.Symbols {
+			prog.Symbols = append(prog.Symbols, binfmt.Symbol{Name: s.Name, Addr: p.base + s.Addr})
+		}
+		for _, l := range p.Object.Lines {
+			prog.Lines = append(prog.Lines, binfmt.Line{Addr: p.base + l.Addr, Line: l.Line})
+		}
+	}
+	if len(prog.Code) > 0xFFFF {
+		errs = append(errs, fmt.Errorf("program is too large: %d bytes", len(prog.Code)))
+	}
+
+	// Now patch each reference, preferring the object's own symbols.
+	for _, p := range included {
+		for _, r := range p.Object.Relocs {
+			addr, ok := p.local[r.Symbol]
+			if ok {
+				addr += p.base
+			} else if def, found := globals[r.Symbol]; found {
+				addr = def.obj.base + def.addr
+			} else {
+				errs = append(errs, fmt.Errorf("%s: undefined symbol '%s' at %04X", p.Name, r.Symbol, r.Offset))
+				continue
+			}
+			code := prog.Code[p.base+r.Offset:]
+			binary.LittleEndian.PutUint16(code, binary.LittleEndian.Uint16(code)+uint16(addr))
+		}
+	}
+
+	if entry != "" {
+		def, ok := globals[entry]
+		if !ok {
+			errs = append(errs, fmt.Errorf("undefined entry point '%s'", entry))
+		} else {
+			prog.Entry = def.obj.base + def.addr
+		}
+	}
+
+	if prog.Features&^opcode.AllFeatures != 0 {
+		errs = append(errs, fmt.Errorf("objects require unsupported features %04X", prog.Features&^opcode.AllFeatures))
+	}
+
+	sort.SliceStable(prog.Symbols, func(i, j int) bool { return prog.Symbols[i].Addr < prog.Symbols[j].Addr })
+	return prog, errs
+}
+
+// providesNeeded returns true if the given object exports a symbol
+// which an included object imports, and which isn't yet defined.
+func providesNeeded(obj *binfmt.Object, included []*placed, globals map[string]definition) bool {
+	exports := make(map[string]bool)
+	for _, name := range obj.Exports {
+		exports[name] = true
+	}
+	for _, p := range included {
+		for _, name := range p.Object.Imports() {
+			if _, ok := globals[name]; !ok && exports[name] {
+				return true
+			}
+		}
+	}
+	return false
+}
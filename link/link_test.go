@@ -0,0 +1,97 @@
+package link
+
+import (
+	"strings"
+	"testing"
+
+	"gosc-vm/binfmt"
+	"gosc-vm/compiler"
+	"gosc-vm/lexer"
+)
+
+// object compiles the given source to an object.
+func object(name string, src string) Input {
+	c := compiler.New(lexer.New(src))
+	c.Compile()
+	return Input{Name: name, Object: c.Object()}
+}
+
+// symbol returns the address of the named symbol in the program.
+func symbol(prog *binfmt.Program, name string) int {
+	for _, s := range prog.Symbols {
+		if s.Name == name {
+			return s.Addr
+		}
+	}
+	return -1
+}
+
+func TestLink(t *testing.T) {
+	main := object("main.o", `
+	.extern greet
+	.global main
+:main
+	call greet
+	jmp main
+`)
+	lib := object("greet.o", `
+	.global greet
+:greet
+	store #1, "hi"
+	print_str #1
+:main
+	ret
+`)
+	unused := object("unused.o", `
+	.global unused
+:unused
+	ret
+`)
+
+	prog, errs := Link([]Input{main}, []Input{unused, lib}, "main")
+	if len(errs) > 0 {
+		t.Fatalf("unexpected errors: %v", errs)
+	}
+
+	// main.o is six bytes long, and greet.o follows it.
+	if len(prog.Code) != 6+9 {
+		t.Fatalf("unexpected length %d - was the unused object included?", len(prog.Code))
+	}
+	if prog.Code[1] != 6 || prog.Code[2] != 0 {
+		t.Errorf("call not relocated: % X", prog.Code)
+	}
+	// Each object's "main" refers to its own label, and the jump to it
+	// is relative, so needs no relocation.
+	if prog.Code[4] != 0xFA || prog.Code[5] != 0xFF {
+		t.Errorf("jump misplaced: % X", prog.Code)
+	}
+	if symbol(prog, "greet") != 6 || prog.Entry != 0 {
+		t.Errorf("bad symbols, or entry: %v %d", prog.Symbols, prog.Entry)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	a := object("a.o", `
+	.global dup
+	.extern missing
+:dup
+	call missing
+`)
+	b := object("b.o", `
+	.global dup
+:dup
+	ret
+`)
+
+	_, errs := Link([]Input{a, b}, nil, "")
+	var msgs []string
+	for _, err := range errs {
+		msgs = append(msgs, err.Error())
+	}
+	got := strings.Join(msgs, "\n")
+	for _, want := range []string{"duplicate symbol 'dup' in b.o, already defined in a.o", "a.o: undefined symbol 'missing'"} {
+		if !strings.Contains(got, want) {
+			t.Errorf("expected %q in:\n%s", want, got)
+		}
+	}
+}
@@ -0,0 +1,227 @@
+// Package macro expands assembler macros, sitting between our lexer and
+// our compiler.
+//
+// A macro is defined with its parameters on the same line as its name:
+//
+//	.macro print_dec_nl value
+//	    store #1, value
+//	    call print_dec
+//	    store #1, "\n"
+//	    print_str #1
+//	.endm
+//
+// and is invoked by name, with its arguments on the same line, separated
+// by commas.  Each use of a parameter within the body is replaced by the
+// argument, and each label whose name starts with "%%" is replaced by
+// one unique to the expansion, so a macro may contain loops.  Macros may
+// invoke other macros, and even define them.
+package macro
+
+import (
+	"fmt"
+	"os"
+	"strings"
+
+	"gosc-vm/token"
+)
+
+// maxDepth limits the nesting of macros, to catch those which invoke
+// themselves forever.
+const maxDepth = 100
+
+// Source is a stream of tokens, such as our lexer.
+type Source interface {
+	NextToken() token.Token
+}
+
+// Macro is a macro definition.
+type Macro struct {
+	Name   string
+	Params []string
+	Body   []token.Token
+}
+
+// Expander reads tokens from a source, and expands the macros within.
+type Expander struct {
+	src     Source            // where our tokens come from
+	macros  map[string]*Macro // the macros defined so far
+	pending []token.Token     // tokens read ahead, or expanded
+	count   int               // the number of expansions, for labels
+}
+
+// New returns an expander reading from the given source.
+func New(src Source) *Expander {
+	return &Expander{src: src, macros: make(map[string]*Macro)}
+}
+
+// NextToken returns the next token, after expanding macros.
+func (e *Expander) NextToken() token.Token {
+	for {
+		tok := e.next()
+		switch {
+		case tok.Type == token.DIRECTIVE && tok.Literal == ".macro":
+			e.define(tok)
+		case tok.Type == token.DIRECTIVE && tok.Literal == ".endm":
+			fail(tok, ".endm without .macro")
+		case tok.Type == token.IDENT && e.macros[tok.Literal] != nil:
+			e.expand(tok)
+		default:
+			return tok
+		}
+	}
+}
+
+// next returns the next token, before expansion.
+func (e *Expander) next() token.Token {
+	tok := e.peek()
+	e.pending = e.pending[1:]
+	return tok
+}
+
+// peek returns the next token, without consuming it.
+func (e *Expander) peek() token.Token {
+	if len(e.pending) == 0 {
+		e.pending = append(e.pending, e.src.NextToken())
+	}
+	return e.pending[0]
+}
+
+// NextRaw returns the next token without expanding it, nor defining any
+// macro, for skipping code which isn't to be assembled.
+func (e *Expander) NextRaw() token.Token {
+	return e.next()
+}
+
+// Rest returns the tokens which follow the given one on the same line,
+// without expanding them.
+func (e *Expander) Rest(tok token.Token) []token.Token {
+	var out []token.Token
+	for {
+		next := e.peek()
+		if next.Type == token.EOF || next.Line != tok.Line || next.File != tok.File || next.Expansion != tok.Expansion {
+			return out
+		}
+		out = append(out, e.next())
+	}
+}
+
+// define reads the definition of a macro.
+func (e *Expander) define(dir token.Token) {
+	name := e.next()
+	if name.Type != token.IDENT || name.Line != dir.Line {
+		fail(name, "expected the name of a macro, got '%s'", name.Literal)
+	}
+	m := &Macro{Name: name.Literal}
+
+	for _, param := range split(name, e.Rest(name)) {
+		if len(param) != 1 || param[0].Type != token.IDENT || strings.HasPrefix(param[0].Literal, "#") {
+			fail(name, "invalid parameter for macro '%s'", m.Name)
+		}
+		m.Params = append(m.Params, param[0].Literal)
+	}
+
+	// The body runs until the matching .endm, skipping those of any
+	// macros defined within it.
+	depth := 0
+	for {
+		tok := e.next()
+		if tok.Type == token.EOF {
+			fail(name, "missing .endm for macro '%s'", m.Name)
+		}
+		if tok.Type == token.DIRECTIVE && tok.Literal == ".macro" {
+			depth++
+		}
+		if tok.Type == token.DIRECTIVE && tok.Literal == ".endm" {
+			if depth == 0 {
+				break
+			}
+			depth--
+		}
+		m.Body = append(m.Body, tok)
+	}
+	e.macros[m.Name] = m
+}
+
+// expand replaces the invocation of a macro with its body.
+func (e *Expander) expand(inv token.Token) {
+	m := e.macros[inv.Literal]
+
+	args := split(inv, e.Rest(inv))
+	if len(args) != len(m.Params) {
+		fail(inv, "macro '%s' expects %d arguments, got %d", m.Name, len(m.Params), len(args))
+	}
+
+	exp := &token.Expansion{Macro: m.Name, File: inv.File, Line: inv.Line, Parent: inv.Expansion}
+	depth := 0
+	for p := exp; p != nil; p = p.Parent {
+		depth++
+	}
+	if depth > maxDepth {
+		fail(inv, "macros nested too deeply - does '%s' invoke itself?", m.Name)
+	}
+	e.count++
+
+	var out []token.Token
+	for _, tok := range m.Body {
+		// Arguments take the place of the parameter, so they
+		// appear to be on the line which used it.
+		sub := []token.Token{tok}
+		for i, param := range m.Params {
+			if tok.Type == token.IDENT && tok.Literal == param {
+				sub = args[i]
+			}
+		}
+
+		for _, t := range sub {
+			t.File = tok.File
+			t.Line = tok.Line
+			t.Expansion = exp
+			t.Literal = e.unique(t)
+			out = append(out, t)
+		}
+	}
+	e.pending = append(out, e.pending...)
+}
+
+// unique returns the literal of the given token, with the names of any
+// macro-local labels made unique to the current expansion.
+func (e *Expander) unique(tok token.Token) string {
+	prefix := ""
+	name := tok.Literal
+	if tok.Type == token.LABEL {
+		prefix = ":"
+		name = strings.TrimPrefix(name, ":")
+	}
+	if !strings.HasPrefix(name, "%%") {
+		return tok.Literal
+	}
+	return fmt.Sprintf("%s%s@%d", prefix, strings.TrimPrefix(name, "%%"), e.count)
+}
+
+// split divides a list of tokens at the commas within it.
+func split(tok token.Token, tokens []token.Token) [][]token.Token {
+	if len(tokens) == 0 {
+		return nil
+	}
+
+	var out [][]token.Token
+	var cur []token.Token
+	for _, t := range append(tokens, token.Token{Type: token.COMMA}) {
+		if t.Type != token.COMMA {
+			cur = append(cur, t)
+			continue
+		}
+		if len(cur) == 0 {
+			fail(tok, "missing argument")
+		}
+		out = append(out, cur)
+		cur = nil
+	}
+	return out
+}
+
+// fail reports an error at the given token, and exits.
+func fail(tok token.Token, format string, args ...interface{}) {
+	fmt.Printf("ERROR: %s: %s\n", tok.Location(), fmt.Sprintf(format, args...))
+	os.Exit(1)
+}
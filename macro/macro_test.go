@@ -0,0 +1,112 @@
+package macro
+
+import (
+	"strings"
+	"testing"
+
+	"gosc-vm/lexer"
+	"gosc-vm/token"
+)
+
+// expand returns the tokens of the given source, after expansion.
+func expand(src string) []token.Token {
+	e := New(lexer.New(src))
+
+	var out []token.Token
+	for {
+		tok := e.NextToken()
+		if tok.Type == token.EOF {
+			return out
+		}
+		out = append(out, tok)
+	}
+}
+
+// literals returns the literals of the given tokens, space-separated.
+func literals(tokens []token.Token) string {
+	var out []string
+	for _, tok := range tokens {
+		out = append(out, tok.Literal)
+	}
+	return strings.Join(out, " ")
+}
+
+func TestExpand(t *testing.T) {
+	tests := []struct {
+		input    string
+		expected string
+	}{
+		// no macros at all
+		{"store #1, 2", "store #1 , 2"},
+
+		// parameters
+		{`.macro set reg, value
+	store reg, value
+.endm
+	set #1, 2
+	set #3, "hi"`, `store #1 , 2 store #3 , hi`},
+
+		// no parameters
+		{`.macro stop
+	exit
+.endm
+	stop
+	stop`, "exit exit"},
+
+		// local labels are unique to each expansion
+		{`.macro spin
+:%%loop
+	jmp %%loop
+.endm
+	spin
+	spin`, ":loop@1 jmp loop@1 :loop@2 jmp loop@2"},
+
+		// nesting, with an argument passed down
+		{`.macro inner x
+	inc x
+.endm
+.macro outer y
+	inner y
+	inner #0
+.endm
+	outer #4`, "inc #4 inc #0"},
+
+		// macros defined by macros
+		{`.macro maker name
+.macro name
+	nop
+.endm
+.endm
+	maker made
+	made`, "nop"},
+	}
+
+	for _, tt := range tests {
+		got := literals(expand(tt.input))
+		if got != tt.expected {
+			t.Errorf("expanding %q - expected %q, got %q", tt.input, tt.expected, got)
+		}
+	}
+}
+
+func TestLocation(t *testing.T) {
+	tokens := expand(`
+.macro inner
+	exit
+.endm
+.macro outer
+	nop
+	inner
+.endm
+	outer`)
+
+	if len(tokens) != 2 {
+		t.Fatalf("unexpected tokens %v", tokens)
+	}
+	if loc := tokens[0].Location(); loc != "line 6, in macro 'outer' invoked at line 9" {
+		t.Errorf("unexpected location %q", loc)
+	}
+	if loc := tokens[1].Location(); loc != "line 3, in macro 'inner' invoked at line 7, in macro 'outer' invoked at line 9" {
+		t.Errorf("unexpected location %q", loc)
+	}
+}
@@ -13,8 +13,12 @@ func main() {
 	subcommands.Register(subcommands.FlagsCommand(), "")
 	subcommands.Register(subcommands.CommandsCommand(), "")
 	subcommands.Register(&compileCmd{}, "")
+	subcommands.Register(&disassembleCmd{}, "")
 	subcommands.Register(&executeCmd{}, "")
+	subcommands.Register(&linkCmd{}, "")
+	subcommands.Register(&opcodesCmd{}, "")
 	subcommands.Register(&runCmd{}, "")
+	subcommands.Register(&verifyCmd{}, "")
 
 	flag.Parse()
 	ctx := context.Background()
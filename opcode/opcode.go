@@ -1,6 +1,13 @@
+// Package opcode describes the instruction set of our virtual machine.
 package opcode
 
-var (
+// Registers is the number of registers our CPU has, which a Reg operand
+// may name.
+const Registers = 16
+
+// The opcodes of our instructions.  These are described, along with their
+// mnemonics and operands, by the instruction table in table.go.
+const (
 	EXIT = 0x00
 
 	// Int operations
@@ -9,10 +16,25 @@ var (
 	INT_TOSTRING = 0x03
 	INT_RANDOM   = 0x04
 
+	// Formatted output
+	PRINTF     = 0x05
+	PRINT_MODE = 0x06
+
 	// Jumps
-	JUMP_TO = 0x10
-	JUMP_Z  = 0x11
-	JUMP_NZ = 0x12
+	JUMP_TO  = 0x10
+	JUMP_Z   = 0x11
+	JUMP_NZ  = 0x12
+	JUMP_REG = 0x13
+	JUMP_LT  = 0x14
+	JUMP_GT  = 0x15
+
+	// Jumps relative to the next instruction, which the compiler
+	// prefers, so that code may be loaded at any address.
+	JUMP_REL    = 0x16
+	JUMP_Z_REL  = 0x17
+	JUMP_NZ_REL = 0x18
+	JUMP_LT_REL = 0x19
+	JUMP_GT_REL = 0x1A
 
 	// Mathematical
 	XOR_OP = 0x20
@@ -24,6 +46,32 @@ var (
 	DEC_OP = 0x26
 	AND_OP = 0x27
 	OR_OP  = 0x28
+	MOD_OP = 0x29
+	SHL_OP = 0x2A
+	SHR_OP = 0x2B
+	SAR_OP = 0x2C
+	MIN_OP = 0x2D
+	MAX_OP = 0x2E
+	NOT_OP = 0x2F
+
+	// Mathematical, with an immediate second operand.  These mirror
+	// the register forms above, and the slots of INC/DEC, which have
+	// no immediate form, hold the remaining unary operations.
+	XOR_IMMEDIATE = 0x80
+	ADD_IMMEDIATE = 0x81
+	SUB_IMMEDIATE = 0x82
+	MUL_IMMEDIATE = 0x83
+	DIV_IMMEDIATE = 0x84
+	NEG_OP        = 0x85
+	ABS_OP        = 0x86
+	AND_IMMEDIATE = 0x87
+	OR_IMMEDIATE  = 0x88
+	MOD_IMMEDIATE = 0x89
+	SHL_IMMEDIATE = 0x8A
+	SHR_IMMEDIATE = 0x8B
+	SAR_IMMEDIATE = 0x8C
+	MIN_IMMEDIATE = 0x8D
+	MAX_IMMEDIATE = 0x8E
 
 	// String operations
 	STRING_STORE  = 0x30
@@ -31,6 +79,12 @@ var (
 	STRING_CONCAT = 0x32
 	STRING_SYSTEM = 0x33
 	STRING_TOINT  = 0x34
+	STRING_LOAD   = 0x35
+	STRING_SAVE   = 0x36
+	STRING_LOADP  = 0x37
+	STRING_SAVEP  = 0x38
+	STRING_CHR    = 0x39
+	STRING_ORD    = 0x3A
 
 	// Comparision functions
 	CMP_REG       = 0x40
@@ -38,6 +92,57 @@ var (
 	CMP_STRING    = 0x42
 	IS_STRING     = 0x43
 	IS_INTEGER    = 0x44
+	STRING_CMP    = 0x45
+
+	// String manipulation, working upon characters (runes)
+	STRING_LENGTH  = 0x90
+	STRING_SUBSTR  = 0x91
+	STRING_INDEX   = 0x92
+	STRING_CHARAT  = 0x93
+	STRING_REPLACE = 0x94
+	STRING_UPPER   = 0x95
+	STRING_LOWER   = 0x96
+	STRING_TRIM    = 0x97
+	STRING_SPLIT   = 0x98
+
+	// String manipulation, working upon bytes
+	STRING_BLENGTH = 0x99
+	STRING_BSUBSTR = 0x9A
+	STRING_BINDEX  = 0x9B
+	STRING_BYTEAT  = 0x9C
+
+	// Floating-point operations
+	FLOAT_STORE    = 0xA0
+	FLOAT_ADD      = 0xA1
+	FLOAT_SUB      = 0xA2
+	FLOAT_MUL      = 0xA3
+	FLOAT_DIV      = 0xA4
+	FLOAT_CMP      = 0xA5
+	FLOAT_SQRT     = 0xA6
+	FLOAT_FLOOR    = 0xA7
+	FLOAT_CEIL     = 0xA8
+	INT_TOFLOAT    = 0xA9
+	FLOAT_TOINT    = 0xAA
+	FLOAT_TOSTRING = 0xAB
+	STRING_TOFLOAT = 0xAC
+	FLOAT_PRINT    = 0xAD
+	IS_FLOAT       = 0xAE
+
+	// Arbitrary-precision integer operations
+	INT_TOBIG    = 0xB0
+	BIG_ADD      = 0xB1
+	BIG_SUB      = 0xB2
+	BIG_MUL      = 0xB3
+	BIG_DIV      = 0xB4
+	BIG_MOD      = 0xB5
+	BIG_POW      = 0xB6
+	BIG_CMP      = 0xB7
+	BIG_TOSTRING = 0xB8
+	STRING_TOBIG = 0xB9
+	BIG_PRINT    = 0xBA
+	BIG_TOINT    = 0xBB
+	IS_BIG       = 0xBC
+	BIG_EXPMOD   = 0xBD
 
 	// Misc things
 	NOP_OP    = 0x50
@@ -47,10 +152,14 @@ var (
 	PEEK   = 0x60
 	POKE   = 0x61
 	MEMCPY = 0x62
+	ALLOC  = 0x63
+	FREE   = 0x64
 
 	// Stack operations
 	STACK_PUSH = 0x70
 	STACK_POP  = 0x71
 	STACK_RET  = 0x72
 	STACK_CALL = 0x73
+	CALL_REG   = 0x74
+	CALL_REL   = 0x75
 )
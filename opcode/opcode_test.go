@@ -0,0 +1,55 @@
+package opcode
+
+import "testing"
+
+// TestTable ensures each opcode is described once, and can be found by
+// its mnemonic.
+func TestTable(t *testing.T) {
+	seen := make(map[byte]string)
+	for _, ins := range Table {
+		if prev, ok := seen[ins.Code]; ok {
+			t.Errorf("opcode %02X used by both %s and %s", ins.Code, prev, ins.Name)
+		}
+		seen[ins.Code] = ins.Name
+
+		found := false
+		for _, cand := range ByMnemonic(ins.Mnemonic) {
+			if cand.Code == ins.Code {
+				found = true
+			}
+		}
+		if !found {
+			t.Errorf("%s not found via mnemonic %s", ins.Name, ins.Mnemonic)
+		}
+
+		for i, o := range ins.Operands {
+			if o == RegList && i != len(ins.Operands)-1 {
+				t.Errorf("%s has a register-list which is not its final operand", ins.Name)
+			}
+		}
+	}
+}
+
+// TestDecode decodes an instruction with variable-length operands.
+func TestDecode(t *testing.T) {
+	code := []byte{PRINTF, 3, 2, 4, 5, STRING_STORE, 1, 2, 0, 'h', 'i'}
+	fetch := func(addr int) byte { return code[addr] }
+
+	d, ok := Decode(fetch, 0)
+	if !ok || d.Code != PRINTF || d.Length != 5 {
+		t.Fatalf("bad decode of printf: %v", d)
+	}
+	if d.Args[0].Int != 3 || len(d.Args[1].Regs) != 2 || d.Args[1].Regs[1] != 5 {
+		t.Fatalf("bad printf operands: %v", d.Args)
+	}
+
+	d, ok = Decode(fetch, 5)
+	if !ok || d.Code != STRING_STORE || d.Length != 6 || d.Args[1].Str != "hi" {
+		t.Fatalf("bad decode of string store: %v", d)
+	}
+
+	code[0] = 0xFF
+	if _, ok := Decode(fetch, 0); ok {
+		t.Fatalf("decoded an unknown opcode")
+	}
+}
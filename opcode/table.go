@@ -0,0 +1,437 @@
+package opcode
+
+import (
+	"encoding/binary"
+	"fmt"
+	"math"
+	"sort"
+	"strings"
+)
+
+// Operand describes the kind, and encoding, of an instruction operand.
+type Operand int
+
+// The kinds of operand an instruction may take.
+const (
+	// Reg is a register, "#0" to "#15", encoded as a single byte.
+	Reg Operand = iota
+	// Imm16 is an immediate value, or label address, encoded as two
+	// bytes, little-endian.
+	Imm16
+	// Addr is a jump or call target, encoded as two bytes, little-endian.
+	Addr
+	// Rel is a jump or call target, encoded as two bytes, little-endian,
+	// holding its signed offset from the end of the instruction.
+	Rel
+	// Byte is a small immediate value, encoded as a single byte.
+	Byte
+	// Str is a string, encoded as a two-byte length then the bytes.
+	Str
+	// Float is a floating-point value, encoded as eight bytes.
+	Float
+	// RegList is any number of registers, encoded as a count byte and
+	// then the registers.  It may only be the final operand.
+	RegList
+)
+
+// String returns the name of the operand kind, as used in our docs.
+func (o Operand) String() string {
+	switch o {
+	case Reg:
+		return "#reg"
+	case Imm16:
+		return "imm16"
+	case Addr, Rel:
+		return "addr"
+	case Byte:
+		return "byte"
+	case Str:
+		return "\"string\""
+	case Float:
+		return "float"
+	case RegList:
+		return "#reg..."
+	}
+	return "?"
+}
+
+// Size returns the fixed size of the operand's encoding.  For strings
+// and register lists this is the size of the length-prefix alone.
+func (o Operand) Size() int {
+	switch o {
+	case Imm16, Addr, Rel, Str:
+		return 2
+	case Float:
+		return 8
+	}
+	return 1
+}
+
+// Instruction describes a single instruction of our virtual machine.
+type Instruction struct {
+	// Name is the name of the opcode constant, e.g. "ADD_OP".
+	Name string
+	// Code is the opcode.
+	Code byte
+	// Mnemonic is the keyword used in our assembly language.  Several
+	// instructions may share a mnemonic, so long as their operands
+	// differ, e.g. "store".
+	Mnemonic string
+	// Aliases are alternative mnemonics, e.g. "goto" for "jmp".
+	Aliases []string
+	// Operands are the kinds of operand the instruction takes.
+	Operands []Operand
+	// Values are the names which may be used for a Byte operand.
+	Values map[string]int
+	// Doc is a short description of the instruction.
+	Doc string
+}
+
+// Length returns the length of the instruction's encoding, excluding the
+// bodies of any string or register-list operands.
+func (i Instruction) Length() int {
+	len := 1
+	for _, o := range i.Operands {
+		len += o.Size()
+	}
+	return len
+}
+
+// Syntax returns the assembly-language syntax of the instruction.
+func (i Instruction) Syntax() string {
+	var ops []string
+	for _, o := range i.Operands {
+		ops = append(ops, o.String())
+	}
+	if len(ops) == 0 {
+		return i.Mnemonic
+	}
+	return i.Mnemonic + " " + strings.Join(ops, ", ")
+}
+
+// The optional parts of our instruction set.  A program records those
+// it uses, so that a machine lacking them can refuse to run it.
+const (
+	// FeatureFloat is the floating-point instructions.
+	FeatureFloat uint16 = 1 << iota
+	// FeatureBig is the arbitrary-precision integer instructions.
+	FeatureBig
+)
+
+// AllFeatures holds every feature of our instruction set.
+const AllFeatures = FeatureFloat | FeatureBig
+
+// Features returns the optional features the instruction belongs to.
+func (i Instruction) Features() uint16 {
+	switch i.Code & 0xF0 {
+	case 0xA0:
+		return FeatureFloat
+	case 0xB0:
+		return FeatureBig
+	}
+	return 0
+}
+
+// Table is our instruction set.
+var Table = []Instruction{
+	{Name: "EXIT", Code: EXIT, Mnemonic: "exit", Doc: "Stop execution."},
+
+	// Int operations
+	{Name: "INT_STORE", Code: INT_STORE, Mnemonic: "store", Operands: []Operand{Reg, Imm16}, Doc: "Store an integer, or label address, in a register."},
+	{Name: "INT_PRINT", Code: INT_PRINT, Mnemonic: "print_int", Operands: []Operand{Reg}, Doc: "Print an integer, as selected by print_mode."},
+	{Name: "INT_TOSTRING", Code: INT_TOSTRING, Mnemonic: "int2string", Operands: []Operand{Reg}, Doc: "Convert an integer register to a string."},
+	{Name: "INT_RANDOM", Code: INT_RANDOM, Mnemonic: "random", Operands: []Operand{Reg}, Doc: "Store a random integer in a register."},
+
+	// Formatted output
+	{Name: "PRINTF", Code: PRINTF, Mnemonic: "printf", Operands: []Operand{Reg, RegList}, Doc: "Print registers according to a format-string register."},
+	{Name: "PRINT_MODE", Code: PRINT_MODE, Mnemonic: "print_mode", Operands: []Operand{Byte},
+		Values: map[string]int{"hex": 0, "dec": 1, "decimal": 1, "bin": 2, "binary": 2},
+		Doc:    "Select how print_int shows integers: hex, decimal, or binary."},
+
+	// Jumps, of which those relative to the next instruction come first,
+	// so that the compiler prefers them
+	{Name: "JUMP_REL", Code: JUMP_REL, Mnemonic: "jmp", Aliases: []string{"goto"}, Operands: []Operand{Rel}, Doc: "Jump to an address, relative to the next instruction."},
+	{Name: "JUMP_Z_REL", Code: JUMP_Z_REL, Mnemonic: "jmpz", Operands: []Operand{Rel}, Doc: "Jump, relative to the next instruction, if the zero-flag is set."},
+	{Name: "JUMP_NZ_REL", Code: JUMP_NZ_REL, Mnemonic: "jmpnz", Operands: []Operand{Rel}, Doc: "Jump, relative to the next instruction, if the zero-flag is clear."},
+	{Name: "JUMP_LT_REL", Code: JUMP_LT_REL, Mnemonic: "jmplt", Operands: []Operand{Rel}, Doc: "Jump, relative to the next instruction, if the less-than flag is set."},
+	{Name: "JUMP_GT_REL", Code: JUMP_GT_REL, Mnemonic: "jmpgt", Operands: []Operand{Rel}, Doc: "Jump, relative to the next instruction, if the greater-than flag is set."},
+	{Name: "JUMP_TO", Code: JUMP_TO, Mnemonic: "jmp", Aliases: []string{"goto"}, Operands: []Operand{Addr}, Doc: "Jump to an address."},
+	{Name: "JUMP_REG", Code: JUMP_REG, Mnemonic: "jmp", Aliases: []string{"goto"}, Operands: []Operand{Reg}, Doc: "Jump to the address held in a register."},
+	{Name: "JUMP_Z", Code: JUMP_Z, Mnemonic: "jmpz", Operands: []Operand{Addr}, Doc: "Jump if the zero-flag is set."},
+	{Name: "JUMP_NZ", Code: JUMP_NZ, Mnemonic: "jmpnz", Operands: []Operand{Addr}, Doc: "Jump if the zero-flag is clear."},
+	{Name: "JUMP_LT", Code: JUMP_LT, Mnemonic: "jmplt", Operands: []Operand{Addr}, Doc: "Jump if the less-than flag is set."},
+	{Name: "JUMP_GT", Code: JUMP_GT, Mnemonic: "jmpgt", Operands: []Operand{Addr}, Doc: "Jump if the greater-than flag is set."},
+
+	// Mathematical
+	{Name: "XOR_OP", Code: XOR_OP, Mnemonic: "xor", Operands: []Operand{Reg, Reg, Reg}, Doc: "Bitwise exclusive-or."},
+	{Name: "ADD_OP", Code: ADD_OP, Mnemonic: "add", Operands: []Operand{Reg, Reg, Reg}, Doc: "Addition."},
+	{Name: "SUB_OP", Code: SUB_OP, Mnemonic: "sub", Operands: []Operand{Reg, Reg, Reg}, Doc: "Subtraction."},
+	{Name: "MUL_OP", Code: MUL_OP, Mnemonic: "mul", Operands: []Operand{Reg, Reg, Reg}, Doc: "Multiplication."},
+	{Name: "DIV_OP", Code: DIV_OP, Mnemonic: "div", Operands: []Operand{Reg, Reg, Reg}, Doc: "Division."},
+	{Name: "INC_OP", Code: INC_OP, Mnemonic: "inc", Operands: []Operand{Reg}, Doc: "Increment a register."},
+	{Name: "DEC_OP", Code: DEC_OP, Mnemonic: "dec", Operands: []Operand{Reg}, Doc: "Decrement a register."},
+	{Name: "AND_OP", Code: AND_OP, Mnemonic: "and", Operands: []Operand{Reg, Reg, Reg}, Doc: "Bitwise and."},
+	{Name: "OR_OP", Code: OR_OP, Mnemonic: "or", Operands: []Operand{Reg, Reg, Reg}, Doc: "Bitwise or."},
+	{Name: "MOD_OP", Code: MOD_OP, Mnemonic: "mod", Operands: []Operand{Reg, Reg, Reg}, Doc: "Remainder after division."},
+	{Name: "SHL_OP", Code: SHL_OP, Mnemonic: "shl", Operands: []Operand{Reg, Reg, Reg}, Doc: "Shift left."},
+	{Name: "SHR_OP", Code: SHR_OP, Mnemonic: "shr", Operands: []Operand{Reg, Reg, Reg}, Doc: "Shift right, filling with zeros."},
+	{Name: "SAR_OP", Code: SAR_OP, Mnemonic: "sar", Operands: []Operand{Reg, Reg, Reg}, Doc: "Shift right, preserving the sign."},
+	{Name: "MIN_OP", Code: MIN_OP, Mnemonic: "min", Operands: []Operand{Reg, Reg, Reg}, Doc: "The smaller of two integers."},
+	{Name: "MAX_OP", Code: MAX_OP, Mnemonic: "max", Operands: []Operand{Reg, Reg, Reg}, Doc: "The larger of two integers."},
+	{Name: "NOT_OP", Code: NOT_OP, Mnemonic: "not", Operands: []Operand{Reg, Reg}, Doc: "Bitwise complement."},
+
+	// Mathematical, with an immediate second operand
+	{Name: "XOR_IMMEDIATE", Code: XOR_IMMEDIATE, Mnemonic: "xor", Operands: []Operand{Reg, Reg, Imm16}, Doc: "Bitwise exclusive-or with a constant."},
+	{Name: "ADD_IMMEDIATE", Code: ADD_IMMEDIATE, Mnemonic: "add", Operands: []Operand{Reg, Reg, Imm16}, Doc: "Add a constant."},
+	{Name: "SUB_IMMEDIATE", Code: SUB_IMMEDIATE, Mnemonic: "sub", Operands: []Operand{Reg, Reg, Imm16}, Doc: "Subtract a constant."},
+	{Name: "MUL_IMMEDIATE", Code: MUL_IMMEDIATE, Mnemonic: "mul", Operands: []Operand{Reg, Reg, Imm16}, Doc: "Multiply by a constant."},
+	{Name: "DIV_IMMEDIATE", Code: DIV_IMMEDIATE, Mnemonic: "div", Operands: []Operand{Reg, Reg, Imm16}, Doc: "Divide by a constant."},
+	{Name: "NEG_OP", Code: NEG_OP, Mnemonic: "neg", Operands: []Operand{Reg, Reg}, Doc: "Negate an integer."},
+	{Name: "ABS_OP", Code: ABS_OP, Mnemonic: "abs", Operands: []Operand{Reg, Reg}, Doc: "Absolute value of an integer."},
+	{Name: "AND_IMMEDIATE", Code: AND_IMMEDIATE, Mnemonic: "and", Operands: []Operand{Reg, Reg, Imm16}, Doc: "Bitwise and with a constant."},
+	{Name: "OR_IMMEDIATE", Code: OR_IMMEDIATE, Mnemonic: "or", Operands: []Operand{Reg, Reg, Imm16}, Doc: "Bitwise or with a constant."},
+	{Name: "MOD_IMMEDIATE", Code: MOD_IMMEDIATE, Mnemonic: "mod", Operands: []Operand{Reg, Reg, Imm16}, Doc: "Remainder after division by a constant."},
+	{Name: "SHL_IMMEDIATE", Code: SHL_IMMEDIATE, Mnemonic: "shl", Operands: []Operand{Reg, Reg, Imm16}, Doc: "Shift left by a constant."},
+	{Name: "SHR_IMMEDIATE", Code: SHR_IMMEDIATE, Mnemonic: "shr", Operands: []Operand{Reg, Reg, Imm16}, Doc: "Shift right by a constant, filling with zeros."},
+	{Name: "SAR_IMMEDIATE", Code: SAR_IMMEDIATE, Mnemonic: "sar", Operands: []Operand{Reg, Reg, Imm16}, Doc: "Shift right by a constant, preserving the sign."},
+	{Name: "MIN_IMMEDIATE", Code: MIN_IMMEDIATE, Mnemonic: "min", Operands: []Operand{Reg, Reg, Imm16}, Doc: "The smaller of an integer and a constant."},
+	{Name: "MAX_IMMEDIATE", Code: MAX_IMMEDIATE, Mnemonic: "max", Operands: []Operand{Reg, Reg, Imm16}, Doc: "The larger of an integer and a constant."},
+
+	// String operations
+	{Name: "STRING_STORE", Code: STRING_STORE, Mnemonic: "store", Operands: []Operand{Reg, Str}, Doc: "Store a string in a register."},
+	{Name: "STRING_PRINT", Code: STRING_PRINT, Mnemonic: "print_str", Operands: []Operand{Reg}, Doc: "Print a string."},
+	{Name: "STRING_CONCAT", Code: STRING_CONCAT, Mnemonic: "concat", Operands: []Operand{Reg, Reg, Reg}, Doc: "Concatenate two strings."},
+	{Name: "STRING_SYSTEM", Code: STRING_SYSTEM, Mnemonic: "system", Operands: []Operand{Reg}, Doc: "Run the command held in a string register."},
+	{Name: "STRING_TOINT", Code: STRING_TOINT, Mnemonic: "string2int", Operands: []Operand{Reg}, Doc: "Convert a string register to an integer."},
+	{Name: "STRING_LOAD", Code: STRING_LOAD, Mnemonic: "strload", Operands: []Operand{Reg, Reg, Reg}, Doc: "Load a string of the given length from RAM."},
+	{Name: "STRING_SAVE", Code: STRING_SAVE, Mnemonic: "strstore", Operands: []Operand{Reg, Reg}, Doc: "Store the bytes of a string in RAM."},
+	{Name: "STRING_LOADP", Code: STRING_LOADP, Mnemonic: "strloadp", Operands: []Operand{Reg, Reg}, Doc: "Load a length-prefixed string from RAM."},
+	{Name: "STRING_SAVEP", Code: STRING_SAVEP, Mnemonic: "strstorep", Operands: []Operand{Reg, Reg}, Doc: "Store a length-prefixed string in RAM."},
+	{Name: "STRING_CHR", Code: STRING_CHR, Mnemonic: "chr", Operands: []Operand{Reg}, Doc: "Convert an integer register to a single-character string."},
+	{Name: "STRING_ORD", Code: STRING_ORD, Mnemonic: "ord", Operands: []Operand{Reg}, Doc: "Convert a single-character string register to an integer."},
+
+	// Comparison functions
+	{Name: "CMP_REG", Code: CMP_REG, Mnemonic: "cmp", Operands: []Operand{Reg, Reg}, Doc: "Compare two registers, setting the flags."},
+	{Name: "CMP_IMMEDIATE", Code: CMP_IMMEDIATE, Mnemonic: "cmp", Operands: []Operand{Reg, Imm16}, Doc: "Compare a register with an integer, setting the flags."},
+	{Name: "CMP_STRING", Code: CMP_STRING, Mnemonic: "cmp", Operands: []Operand{Reg, Str}, Doc: "Compare a register with a string, setting the flags."},
+	{Name: "IS_STRING", Code: IS_STRING, Mnemonic: "is_string", Operands: []Operand{Reg}, Doc: "Set the zero-flag if a register holds a string."},
+	{Name: "IS_INTEGER", Code: IS_INTEGER, Mnemonic: "is_integer", Operands: []Operand{Reg}, Doc: "Set the zero-flag if a register holds an integer."},
+	{Name: "STRING_CMP", Code: STRING_CMP, Mnemonic: "strcmp", Operands: []Operand{Reg, Reg}, Doc: "Compare two strings lexicographically, setting the flags."},
+
+	// Misc things
+	{Name: "NOP_OP", Code: NOP_OP, Mnemonic: "nop", Doc: "Do nothing."},
+	{Name: "REG_STORE", Code: REG_STORE, Mnemonic: "store", Operands: []Operand{Reg, Reg}, Doc: "Copy one register to another."},
+
+	// Load from RAM/store in RAM
+	{Name: "PEEK", Code: PEEK, Mnemonic: "peek", Operands: []Operand{Reg, Reg}, Doc: "Load the byte at an address."},
+	{Name: "POKE", Code: POKE, Mnemonic: "poke", Operands: []Operand{Reg, Reg}, Doc: "Store a byte at an address."},
+	{Name: "MEMCPY", Code: MEMCPY, Mnemonic: "memcpy", Operands: []Operand{Reg, Reg, Reg}, Doc: "Copy a region of RAM: destination, source, length."},
+	{Name: "ALLOC", Code: ALLOC, Mnemonic: "alloc", Operands: []Operand{Reg, Reg}, Doc: "Allocate a block of the given size from the heap."},
+	{Name: "FREE", Code: FREE, Mnemonic: "free", Operands: []Operand{Reg}, Doc: "Return a block to the heap."},
+
+	// Stack operations
+	{Name: "STACK_PUSH", Code: STACK_PUSH, Mnemonic: "push", Operands: []Operand{Reg}, Doc: "Push an integer register onto the stack."},
+	{Name: "STACK_POP", Code: STACK_POP, Mnemonic: "pop", Operands: []Operand{Reg}, Doc: "Pop an integer from the stack."},
+	{Name: "STACK_RET", Code: STACK_RET, Mnemonic: "ret", Doc: "Return from a call."},
+	{Name: "CALL_REL", Code: CALL_REL, Mnemonic: "call", Operands: []Operand{Rel}, Doc: "Call a subroutine, relative to the next instruction."},
+	{Name: "STACK_CALL", Code: STACK_CALL, Mnemonic: "call", Operands: []Operand{Addr}, Doc: "Call a subroutine."},
+	{Name: "CALL_REG", Code: CALL_REG, Mnemonic: "call", Operands: []Operand{Reg}, Doc: "Call the subroutine whose address is held in a register."},
+
+	// String manipulation, working upon characters (runes)
+	{Name: "STRING_LENGTH", Code: STRING_LENGTH, Mnemonic: "strlen", Operands: []Operand{Reg, Reg}, Doc: "Length of a string, in characters."},
+	{Name: "STRING_SUBSTR", Code: STRING_SUBSTR, Mnemonic: "substr", Operands: []Operand{Reg, Reg, Reg, Reg}, Doc: "Substring: destination, string, start, length, in characters."},
+	{Name: "STRING_INDEX", Code: STRING_INDEX, Mnemonic: "indexof", Operands: []Operand{Reg, Reg, Reg}, Doc: "Character offset of a substring, or -1."},
+	{Name: "STRING_CHARAT", Code: STRING_CHARAT, Mnemonic: "charat", Operands: []Operand{Reg, Reg, Reg}, Doc: "The character at an offset, as a string."},
+	{Name: "STRING_REPLACE", Code: STRING_REPLACE, Mnemonic: "replace", Operands: []Operand{Reg, Reg, Reg, Reg}, Doc: "Replace every occurrence of a substring: destination, string, old, new."},
+	{Name: "STRING_UPPER", Code: STRING_UPPER, Mnemonic: "upper", Operands: []Operand{Reg}, Doc: "Convert a string to upper-case."},
+	{Name: "STRING_LOWER", Code: STRING_LOWER, Mnemonic: "lower", Operands: []Operand{Reg}, Doc: "Convert a string to lower-case."},
+	{Name: "STRING_TRIM", Code: STRING_TRIM, Mnemonic: "trim", Operands: []Operand{Reg}, Doc: "Remove leading and trailing whitespace."},
+	{Name: "STRING_SPLIT", Code: STRING_SPLIT, Mnemonic: "split", Operands: []Operand{Reg, Reg, Reg, Reg}, Doc: "Split a string into length-prefixed pieces in RAM: count, string, separator, address."},
+
+	// String manipulation, working upon bytes
+	{Name: "STRING_BLENGTH", Code: STRING_BLENGTH, Mnemonic: "strblen", Operands: []Operand{Reg, Reg}, Doc: "Length of a string, in bytes."},
+	{Name: "STRING_BSUBSTR", Code: STRING_BSUBSTR, Mnemonic: "bsubstr", Operands: []Operand{Reg, Reg, Reg, Reg}, Doc: "Substring: destination, string, start, length, in bytes."},
+	{Name: "STRING_BINDEX", Code: STRING_BINDEX, Mnemonic: "bindexof", Operands: []Operand{Reg, Reg, Reg}, Doc: "Byte offset of a substring, or -1."},
+	{Name: "STRING_BYTEAT", Code: STRING_BYTEAT, Mnemonic: "byteat", Operands: []Operand{Reg, Reg, Reg}, Doc: "The byte at an offset, as an integer."},
+
+	// Floating-point operations
+	{Name: "FLOAT_STORE", Code: FLOAT_STORE, Mnemonic: "store", Operands: []Operand{Reg, Float}, Doc: "Store a floating-point number in a register."},
+	{Name: "FLOAT_ADD", Code: FLOAT_ADD, Mnemonic: "fadd", Operands: []Operand{Reg, Reg, Reg}, Doc: "Floating-point addition."},
+	{Name: "FLOAT_SUB", Code: FLOAT_SUB, Mnemonic: "fsub", Operands: []Operand{Reg, Reg, Reg}, Doc: "Floating-point subtraction."},
+	{Name: "FLOAT_MUL", Code: FLOAT_MUL, Mnemonic: "fmul", Operands: []Operand{Reg, Reg, Reg}, Doc: "Floating-point multiplication."},
+	{Name: "FLOAT_DIV", Code: FLOAT_DIV, Mnemonic: "fdiv", Operands: []Operand{Reg, Reg, Reg}, Doc: "Floating-point division."},
+	{Name: "FLOAT_CMP", Code: FLOAT_CMP, Mnemonic: "fcmp", Operands: []Operand{Reg, Reg}, Doc: "Compare two floating-point numbers, setting the flags."},
+	{Name: "FLOAT_SQRT", Code: FLOAT_SQRT, Mnemonic: "sqrt", Operands: []Operand{Reg, Reg}, Doc: "Square root."},
+	{Name: "FLOAT_FLOOR", Code: FLOAT_FLOOR, Mnemonic: "floor", Operands: []Operand{Reg, Reg}, Doc: "Round down."},
+	{Name: "FLOAT_CEIL", Code: FLOAT_CEIL, Mnemonic: "ceil", Operands: []Operand{Reg, Reg}, Doc: "Round up."},
+	{Name: "INT_TOFLOAT", Code: INT_TOFLOAT, Mnemonic: "int2float", Operands: []Operand{Reg}, Doc: "Convert an integer register to floating-point."},
+	{Name: "FLOAT_TOINT", Code: FLOAT_TOINT, Mnemonic: "float2int", Operands: []Operand{Reg}, Doc: "Convert a floating-point register to an integer, truncating."},
+	{Name: "FLOAT_TOSTRING", Code: FLOAT_TOSTRING, Mnemonic: "float2string", Operands: []Operand{Reg}, Doc: "Convert a floating-point register to a string."},
+	{Name: "STRING_TOFLOAT", Code: STRING_TOFLOAT, Mnemonic: "string2float", Operands: []Operand{Reg}, Doc: "Convert a string register to floating-point."},
+	{Name: "FLOAT_PRINT", Code: FLOAT_PRINT, Mnemonic: "print_float", Operands: []Operand{Reg}, Doc: "Print a floating-point number."},
+	{Name: "IS_FLOAT", Code: IS_FLOAT, Mnemonic: "is_float", Operands: []Operand{Reg}, Doc: "Set the zero-flag if a register holds a floating-point number."},
+
+	// Arbitrary-precision integer operations
+	{Name: "INT_TOBIG", Code: INT_TOBIG, Mnemonic: "int2big", Operands: []Operand{Reg}, Doc: "Promote an integer register to arbitrary-precision."},
+	{Name: "BIG_ADD", Code: BIG_ADD, Mnemonic: "badd", Operands: []Operand{Reg, Reg, Reg}, Doc: "Arbitrary-precision addition."},
+	{Name: "BIG_SUB", Code: BIG_SUB, Mnemonic: "bsub", Operands: []Operand{Reg, Reg, Reg}, Doc: "Arbitrary-precision subtraction."},
+	{Name: "BIG_MUL", Code: BIG_MUL, Mnemonic: "bmul", Operands: []Operand{Reg, Reg, Reg}, Doc: "Arbitrary-precision multiplication."},
+	{Name: "BIG_DIV", Code: BIG_DIV, Mnemonic: "bdiv", Operands: []Operand{Reg, Reg, Reg}, Doc: "Arbitrary-precision (Euclidean) division."},
+	{Name: "BIG_MOD", Code: BIG_MOD, Mnemonic: "bmod", Operands: []Operand{Reg, Reg, Reg}, Doc: "Arbitrary-precision (Euclidean) modulus."},
+	{Name: "BIG_POW", Code: BIG_POW, Mnemonic: "bpow", Operands: []Operand{Reg, Reg, Reg}, Doc: "Arbitrary-precision exponentiation."},
+	{Name: "BIG_CMP", Code: BIG_CMP, Mnemonic: "bcmp", Operands: []Operand{Reg, Reg}, Doc: "Compare two arbitrary-precision integers, setting the flags."},
+	{Name: "BIG_TOSTRING", Code: BIG_TOSTRING, Mnemonic: "big2string", Operands: []Operand{Reg}, Doc: "Convert an arbitrary-precision register to a decimal string."},
+	{Name: "STRING_TOBIG", Code: STRING_TOBIG, Mnemonic: "string2big", Operands: []Operand{Reg}, Doc: "Convert a decimal string register to arbitrary-precision."},
+	{Name: "BIG_PRINT", Code: BIG_PRINT, Mnemonic: "print_big", Operands: []Operand{Reg}, Doc: "Print an arbitrary-precision integer."},
+	{Name: "BIG_TOINT", Code: BIG_TOINT, Mnemonic: "big2int", Operands: []Operand{Reg}, Doc: "Convert an arbitrary-precision register to an integer."},
+	{Name: "IS_BIG", Code: IS_BIG, Mnemonic: "is_big", Operands: []Operand{Reg}, Doc: "Set the zero-flag if a register holds an arbitrary-precision integer."},
+	{Name: "BIG_EXPMOD", Code: BIG_EXPMOD, Mnemonic: "bexpmod", Operands: []Operand{Reg, Reg, Reg, Reg}, Doc: "Modular exponentiation: destination, base, exponent, modulus."},
+}
+
+// byCode and byMnemonic index our table.
+var (
+	byCode     = map[byte]*Instruction{}
+	byMnemonic = map[string][]*Instruction{}
+)
+
+func init() {
+	for i := range Table {
+		ins := &Table[i]
+		byCode[ins.Code] = ins
+		for _, name := range append([]string{ins.Mnemonic}, ins.Aliases...) {
+			byMnemonic[name] = append(byMnemonic[name], ins)
+		}
+	}
+}
+
+// Lookup returns the instruction with the given opcode.
+func Lookup(code byte) (*Instruction, bool) {
+	ins, ok := byCode[code]
+	return ins, ok
+}
+
+// ByMnemonic returns the instructions which may be written with the
+// given mnemonic, or alias.
+func ByMnemonic(name string) []*Instruction {
+	return byMnemonic[name]
+}
+
+// IsMnemonic returns true if the given name is an instruction mnemonic,
+// or alias.
+func IsMnemonic(name string) bool {
+	return len(byMnemonic[name]) > 0
+}
+
+// Arg holds a decoded operand.
+type Arg struct {
+	// Int is the register number, or value, of Reg, Imm16, Addr, and
+	// Byte operands.  For Rel operands it's the target address, found
+	// from the address the instruction was decoded at.
+	Int int
+	// Str is the value of a Str operand.
+	Str string
+	// Float is the value of a Float operand.
+	Float float64
+	// Regs holds the registers of a RegList operand.
+	Regs []byte
+}
+
+// Decoded is an instruction decoded from bytecode.
+type Decoded struct {
+	*Instruction
+	// Addr is the address of the instruction.
+	Addr int
+	// Length is the length of the instruction, including its operands.
+	Length int
+	// Args are the decoded operands.
+	Args []Arg
+}
+
+// Decode decodes the instruction at the given address, using fetch to
+// read each byte.  It returns false if the opcode is unknown.
+func Decode(fetch func(addr int) byte, addr int) (Decoded, bool) {
+	ins, ok := Lookup(fetch(addr))
+	if !ok {
+		return Decoded{}, false
+	}
+
+	d := Decoded{Instruction: ins, Addr: addr}
+	pc := addr + 1
+	read2 := func() int {
+		val := int(fetch(pc)) + int(fetch(pc+1))*256
+		pc += 2
+		return val
+	}
+
+	for _, o := range ins.Operands {
+		var arg Arg
+		switch o {
+		case Reg, Byte:
+			arg.Int = int(fetch(pc))
+			pc++
+		case Imm16, Addr:
+			arg.Int = read2()
+		case Rel:
+			arg.Int = int(int16(read2()))
+		case Str:
+			len := read2()
+			buf := make([]byte, len)
+			for i := range buf {
+				buf[i] = fetch(pc + i)
+			}
+			pc += len
+			arg.Str = string(buf)
+		case Float:
+			var buf [8]byte
+			for i := range buf {
+				buf[i] = fetch(pc + i)
+			}
+			pc += 8
+			arg.Float = math.Float64frombits(binary.LittleEndian.Uint64(buf[:]))
+		case RegList:
+			count := int(fetch(pc))
+			pc++
+			arg.Regs = make([]byte, count)
+			for i := range arg.Regs {
+				arg.Regs[i] = fetch(pc + i)
+			}
+			pc += count
+		}
+		d.Args = append(d.Args, arg)
+	}
+	d.Length = pc - addr
+
+	// Relative targets are from the end of the instruction.
+	for i, o := range ins.Operands {
+		if o == Rel {
+			d.Args[i].Int += addr + d.Length
+		}
+	}
+	return d, true
+}
+
+// Reference returns a markdown description of our instruction set.
+func Reference() string {
+	sorted := make([]Instruction, len(Table))
+	copy(sorted, Table)
+	sort.Slice(sorted, func(i, j int) bool { return sorted[i].Code < sorted[j].Code })
+
+	var out strings.Builder
+	out.WriteString("| Opcode | Name | Syntax | Length | Description |\n")
+	out.WriteString("|--------|------|--------|--------|-------------|\n")
+	for _, ins := range sorted {
+		size := fmt.Sprintf("%d", ins.Length())
+		for _, o := range ins.Operands {
+			if o == Str || o == RegList {
+				size += "+"
+				break
+			}
+		}
+		doc := ins.Doc
+		if len(ins.Aliases) > 0 {
+			doc += " Also written `" + strings.Join(ins.Aliases, "`, `") + "`."
+		}
+		fmt.Fprintf(&out, "| 0x%02X | %s | `%s` | %s | %s |\n", ins.Code, ins.Name, ins.Syntax(), size, doc)
+	}
+	return out.String()
+}
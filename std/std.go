@@ -0,0 +1,50 @@
+// Package std holds our standard library: modules of routines written in
+// our own assembly language, and embedded in the binary.
+//
+// A program includes a module by name, with `.use "std/strings"`, or it
+// may be compiled as an object and linked against the module instead.
+//
+// The labels of a module don't clash with those of the program using it,
+// which may even define its own routine with the name of one the module
+// exports, and so call its own instead.
+//
+// Routines take their arguments in #1 upwards and return their results
+// in #0.  They may overwrite any of #0 to #7, but #8 to #15 are left
+// alone.
+package std
+
+import (
+	"embed"
+	"sort"
+	"strings"
+)
+
+//go:embed *.in
+var files embed.FS
+
+// prefix is the start of the name of each of our modules.
+const prefix = "std/"
+
+// Source returns the source of the named module, e.g. "std/strings".
+func Source(name string) (string, bool) {
+	if !strings.HasPrefix(name, prefix) {
+		return "", false
+	}
+	data, err := files.ReadFile(strings.TrimPrefix(name, prefix) + ".in")
+	if err != nil {
+		return "", false
+	}
+	return string(data), true
+}
+
+// Modules returns the names of our modules, sorted.
+func Modules() []string {
+	entries, _ := files.ReadDir(".")
+
+	var names []string
+	for _, e := range entries {
+		names = append(names, prefix+strings.TrimSuffix(e.Name(), ".in"))
+	}
+	sort.Strings(names)
+	return names
+}
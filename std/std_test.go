@@ -0,0 +1,225 @@
+package std_test
+
+import (
+	"io/ioutil"
+	"os"
+	"testing"
+
+	"gosc-vm/compiler"
+	"gosc-vm/cpu"
+	"gosc-vm/lexer"
+	"gosc-vm/std"
+)
+
+// run compiles and runs the given source, returning what it printed.
+func run(t *testing.T, src string) string {
+	e := compiler.New(lexer.New(src))
+	e.Compile()
+
+	r, w, err := os.Pipe()
+	if err != nil {
+		t.Fatal(err)
+	}
+	stdout := os.Stdout
+	os.Stdout = w
+	defer func() { os.Stdout = stdout }()
+
+	c := cpu.NewCPU()
+	c.LoadProgram(e.Program())
+	err = c.Run()
+	w.Close()
+	if err != nil {
+		t.Fatalf("unexpected error %s", err)
+	}
+
+	out, _ := ioutil.ReadAll(r)
+	return string(out)
+}
+
+func TestModules(t *testing.T) {
+	for _, name := range std.Modules() {
+		src, ok := std.Source(name)
+		if !ok {
+			t.Fatalf("missing source for %s", name)
+		}
+
+		// Each module should compile, as an object for linking.
+		e := compiler.New(lexer.New(src))
+		e.Compile()
+		if obj := e.Object(); len(obj.Exports) == 0 {
+			t.Errorf("%s exports nothing", name)
+		}
+	}
+	if _, ok := std.Source("std/missing"); ok {
+		t.Errorf("found a missing module")
+	}
+}
+
+func TestStrings(t *testing.T) {
+	out := run(t, `
+	.use "std/strings"
+	store #1, "héllo"
+	call str_reverse
+	print_str #0
+	store #1, 0
+	call print_dec
+	store #1, 12345
+	call print_dec
+	store #1, 0
+	sub #1, #1, 42
+	call print_dec
+	exit
+`)
+	if out != "olléh012345-42" {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
+
+func TestProgramLabels(t *testing.T) {
+	// The program's labels may share the names of the library's, and
+	// take precedence over those it exports, without affecting it.
+	out := run(t, `
+	.use "std/strings"
+	.use "std/map"
+	store #1, 7
+	call print_dec
+	call _map_find
+	call int_to_dec
+	exit
+:_map_find
+	store #1, "!"
+	print_str #1
+	ret
+:int_to_dec
+	store #1, "?"
+	print_str #1
+	ret
+`)
+	if out != "7!?" {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
+
+func TestMem(t *testing.T) {
+	out := run(t, `
+	.use "std/mem"
+	.use "std/strings"
+	store #8, 16
+	alloc #8, #8
+	store #9, 16
+	alloc #9, #9
+
+	# two blocks of 'a'
+	store #1, #8
+	store #2, 97
+	store #3, 16
+	call mem_set
+	store #1, #9
+	call mem_set
+
+	store #1, #8
+	store #2, #9
+	store #3, 16
+	call mem_cmp
+	jmpnz fail
+
+	# now make the last byte of the second block smaller
+	add #1, #9, 15
+	store #2, 90
+	poke #2, #1
+	store #1, #8
+	store #2, #9
+	call mem_cmp
+	jmplt fail
+	store #1, #0
+	call print_dec
+	exit
+:fail
+	store #1, "fail"
+	print_str #1
+	exit
+`)
+	if out != "7" {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
+
+func TestSort(t *testing.T) {
+	out := run(t, `
+	.use "std/sort"
+	store #8, 6
+	alloc #8, #8
+	store #1, "fdbeca"
+	strstore #1, #8
+	store #1, #8
+	store #2, 6
+	call sort_bytes
+	store #1, 6
+	strload #0, #8, #1
+	print_str #0
+	exit
+`)
+	if out != "abcdef" {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
+
+func TestMap(t *testing.T) {
+	out := run(t, `
+	.use "std/map"
+	.use "std/strings"
+	store #1, 3
+	call map_new
+	store #8, #0
+
+	# keys 1 and 4 collide
+	store #1, #8
+	store #2, 1
+	store #3, 1000
+	call map_put
+	store #1, #8
+	store #2, 4
+	store #3, 0
+	call map_put
+	store #1, #8
+	store #2, 1
+	store #3, 1001
+	call map_put
+	store #1, #8
+	store #2, 2
+	store #3, 300
+	call map_put
+	jmpz fail
+
+	# the map is full
+	store #1, #8
+	store #2, 9
+	call map_put
+	jmpnz fail
+
+	store #1, #8
+	store #2, 1
+	call map_get
+	jmpz fail
+	store #1, #0
+	call print_dec
+	store #1, #8
+	store #2, 4
+	call map_get
+	jmpz fail
+	store #1, #0
+	call print_dec
+	store #1, #8
+	store #2, 7
+	call map_get
+	jmpnz fail
+	exit
+:fail
+	store #1, "fail"
+	print_str #1
+	exit
+`)
+	if out != "10010" {
+		t.Fatalf("unexpected output %q", out)
+	}
+}
@@ -1,5 +1,11 @@
 package token
 
+import (
+	"fmt"
+
+	"gosc-vm/opcode"
+)
+
 // TokenType is a string
 type TokenType string
 
@@ -7,6 +13,37 @@ type TokenType string
 type Token struct {
 	Type    TokenType
 	Literal string
+	File    string // the file the token came from, if any
+	Line    int    // the line on which the token starts
+
+	// Expansion is set for tokens produced by expanding a macro, in
+	// which case Line is that of the macro's body.
+	Expansion *Expansion
+}
+
+// Expansion records where a macro was invoked.
+type Expansion struct {
+	Macro  string
+	File   string
+	Line   int
+	Parent *Expansion // set if the invocation was itself expanded
+}
+
+// Location describes where a token came from, for diagnostics.
+func (t Token) Location() string {
+	loc := position(t.File, t.Line)
+	for e := t.Expansion; e != nil; e = e.Parent {
+		loc += fmt.Sprintf(", in macro '%s' invoked at %s", e.Macro, position(e.File, e.Line))
+	}
+	return loc
+}
+
+// position describes a line of the given file, which may be unnamed.
+func position(file string, line int) string {
+	if file == "" {
+		return fmt.Sprintf("line %d", line)
+	}
+	return fmt.Sprintf("%s:%d", file, line)
 }
 
 // pre-defined TokenType
@@ -16,112 +53,92 @@ const (
 	IDENT   = "IDENT"
 	LABEL   = "LABEL"
 	INT     = "INT"
+	FLOAT   = "FLOAT"
 	STRING  = "STRING"
 	COMMA   = ","
 
-	// math
-	ADD = "ADD"
-	SUB = "SUB"
-	MUL = "MUL"
-	DIV = "DIV"
-	INC = "INC"
-	DEC = "DEC"
-
-	// control-flow
-	CALL  = "CALL"
-	GOTO  = "GOTO"
-	JMP   = "JMP"
-	JMPNZ = "JMPNZ"
-	JMPZ  = "JMPZ"
-	RET   = "RET"
-
-	// stack
-	PUSH = "PUSH"
-	POP  = "POP"
-
-	// types
-	IS_STRING  = "IS_STRING"
-	IS_INTEGER = "IS_INTEGER"
-	STRING2INT = "STRING2INT"
-	INT2STRING = "INT2STRING"
-
-	// compare
-	CMP = "CMP"
-
-	// store
-	STORE = "STORE"
-
-	// print
-	PRINT_INT = "PRINT_INT"
-	PRINT_STR = "PRINT_STR"
-
-	// memory
-	PEEK = "PEEK"
-	POKE = "POKE"
-
-	//Misc
-	CONCAT = "CONCAT"
-	DATA   = "DATA"
-	DB     = "DB"
-	EXIT   = "EXIT"
-	MEMCPY = "MEMCPY"
-	NOP    = "NOP"
-	RANDOM = "RANDOM"
-	SYSTEM = "SYSTEM"
+	// operators, for integer expressions
+	PLUS     = "+"
+	MINUS    = "-"
+	ASTERISK = "*"
+	SLASH    = "/"
+	LPAREN   = "("
+	RPAREN   = ")"
+	ASSIGN   = "="
+
+	// comparisons, for conditions
+	EQ     = "=="
+	NOT_EQ = "!="
+	LT     = "<"
+	GT     = ">"
+	LT_EQ  = "<="
+	GT_EQ  = ">="
+
+	// INSTRUCTION is any mnemonic, or alias, from the instruction
+	// table in the opcode package.
+	INSTRUCTION = "INSTRUCTION"
+
+	// DIRECTIVE is an assembler directive, such as ".global".
+	DIRECTIVE = "DIRECTIVE"
+
+	// data
+	DATA = "DATA"
+	DB   = "DB"
 )
 
-// reversed keywords
+// reversed keywords, other than our instructions
 var keywords = map[string]TokenType{
+	"DATA": DATA,
+	"DB":   DB,
+}
 
-	// compare
-	"cmp": CMP,
-
-	// types
-	"is_integer": IS_INTEGER,
-	"is_string":  IS_STRING,
-	"int2string": INT2STRING,
-	"string2int": STRING2INT,
-
-	// store
-	"store": STORE,
-
-	// print
-	"print_int": PRINT_INT,
-	"print_str": PRINT_STR,
-
-	// math
-	"add": ADD,
-	"sub": SUB,
-	"mul": MUL,
-	"div": DIV,
-	"inc": INC,
-	"dec": DEC,
-
-	// control-flow
-	"call":  CALL,
-	"goto":  GOTO,
-	"jmp":   JMP,
-	"jmpnz": JMPNZ,
-	"jmpz":  JMPZ,
-	"ret":   RET,
-
-	// stack
-	"push": PUSH,
-	"pop":  POP,
-
-	// memory
-	"peek": PEEK,
-	"poke": POKE,
-
-	// misc
-	"exit":   EXIT,
-	"concat": CONCAT,
-	"DATA":   DATA,
-	"DB":     DB,
-	"memcpy": MEMCPY,
-	"nop":    NOP,
-	"random": RANDOM,
-	"system": SYSTEM,
+// directives holds the names of our assembler directives
+var directives = map[string]bool{
+	".global": true,
+	".extern": true,
+	".use":    true,
+	".macro":  true,
+	".endm":   true,
+
+	".include": true,
+
+	".equ":   true,
+	".const": true,
+
+	".reg":      true,
+	".unreg":    true,
+	".scope":    true,
+	".endscope": true,
+
+	".if":     true,
+	".ifdef":  true,
+	".ifndef": true,
+	".else":   true,
+	".endif":  true,
+
+	".while":    true,
+	".endwhile": true,
+	".for":      true,
+	".next":     true,
+	".break":    true,
+	".continue": true,
+
+	".byte":  true,
+	".word":  true,
+	".dword": true,
+	".ascii": true,
+	".asciz": true,
+	".space": true,
+	".align": true,
+	".org":   true,
+
+	".data": true,
+	".text": true,
+
+	".entry": true,
+
+	".absolute": true,
+	".relative": true,
 }
 
 // LookupIdentifier used to determine whether identifier is keyword nor not
@@ -129,5 +146,11 @@ func LookupIdentifier(identifier string) TokenType {
 	if tok, ok := keywords[identifier]; ok {
 		return tok
 	}
+	if directives[identifier] {
+		return DIRECTIVE
+	}
+	if opcode.IsMnemonic(identifier) {
+		return INSTRUCTION
+	}
 	return IDENT
 }
@@ -0,0 +1,173 @@
+// Package verify checks programs before they are executed.
+//
+// The verifier follows every path through the program from its entry
+// point, decoding each instruction it reaches, so that data embedded in
+// the code is not mistaken for instructions.  The targets of jumps and
+// calls through registers aren't known, so code reached only by those is
+// not checked.
+package verify
+
+import (
+	"fmt"
+	"sort"
+
+	"gosc-vm/binfmt"
+	"gosc-vm/opcode"
+)
+
+// Problem is a fault found in a program.
+type Problem struct {
+	// Addr is the address of the faulty instruction.
+	Addr int
+	// Message describes the fault.
+	Message string
+}
+
+// String returns the problem in a human-readable form.
+func (p Problem) String() string {
+	return fmt.Sprintf("%04X: %s", p.Addr, p.Message)
+}
+
+// jump records a jump, or call, for checking once every instruction has
+// been decoded.
+type jump struct {
+	from   int
+	target int
+}
+
+// Program checks the given program, returning the problems found, sorted
+// by address.
+func Program(prog *binfmt.Program) []Problem {
+	code := prog.Code
+
+	var problems []Problem
+	report := func(addr int, format string, args ...interface{}) {
+		problems = append(problems, Problem{Addr: addr, Message: fmt.Sprintf(format, args...)})
+	}
+
+	// owner holds, for each byte of code, the address of the instruction
+	// it belongs to, plus one, or zero if it hasn't been decoded.
+	owner := make([]int, len(code))
+
+	var jumps []jump
+	todo := []int{prog.Entry}
+	for len(todo) > 0 {
+		addr := todo[len(todo)-1]
+		todo = todo[:len(todo)-1]
+
+		for {
+			if addr >= len(code) {
+				report(addr, "execution runs past the end of the code")
+				break
+			}
+			if owner[addr] != 0 {
+				// already decoded, or lies within another
+				// instruction, which we'll report below
+				break
+			}
+
+			d, ok := decode(code, addr)
+			if !ok {
+				if _, known := opcode.Lookup(code[addr]); !known {
+					report(addr, "unknown opcode %02X", code[addr])
+				} else {
+					report(addr, "%s runs past the end of the code", describe(code, addr))
+				}
+				break
+			}
+			for i := addr; i < addr+d.Length; i++ {
+				if owner[i] == 0 {
+					owner[i] = addr + 1
+				}
+			}
+
+			for i, kind := range d.Operands {
+				arg := d.Args[i]
+				switch kind {
+				case opcode.Reg:
+					if arg.Int >= opcode.Registers {
+						report(addr, "%s uses register #%d, we have %d", d.Mnemonic, arg.Int, opcode.Registers)
+					}
+				case opcode.RegList:
+					for _, r := range arg.Regs {
+						if int(r) >= opcode.Registers {
+							report(addr, "%s uses register #%d, we have %d", d.Mnemonic, r, opcode.Registers)
+						}
+					}
+				case opcode.Addr, opcode.Rel:
+					jumps = append(jumps, jump{from: addr, target: arg.Int})
+					if arg.Int >= 0 && arg.Int < len(code) {
+						todo = append(todo, arg.Int)
+					}
+				}
+			}
+
+			// Does execution continue with the next instruction?
+			if ends(d.Code) {
+				break
+			}
+			addr += d.Length
+		}
+	}
+
+	for _, j := range jumps {
+		switch {
+		case j.target < 0 || j.target >= len(code):
+			report(j.from, "target %04X lies outside the code", j.target)
+		case owner[j.target] != j.target+1:
+			report(j.from, "target %04X lands within the instruction at %04X", j.target, owner[j.target]-1)
+		}
+	}
+
+	sort.SliceStable(problems, func(i, j int) bool { return problems[i].Addr < problems[j].Addr })
+	return problems
+}
+
+// ends returns true if execution doesn't continue with the instruction
+// following one with the given opcode.
+func ends(code byte) bool {
+	switch code {
+	case opcode.EXIT, opcode.JUMP_TO, opcode.JUMP_REL, opcode.JUMP_REG, opcode.STACK_RET:
+		return true
+	}
+	return false
+}
+
+// decode decodes the instruction at the given address, failing if it is
+// unknown or runs past the end of the code.
+func decode(code []byte, addr int) (opcode.Decoded, bool) {
+	truncated := false
+	fetch := func(a int) byte {
+		if a >= len(code) {
+			truncated = true
+			return 0
+		}
+		return code[a]
+	}
+	d, ok := opcode.Decode(fetch, addr)
+	return d, ok && !truncated
+}
+
+// describe names the truncated instruction at the given address,
+// mentioning a string operand whose length runs past the end.
+func describe(code []byte, addr int) string {
+	ins, _ := opcode.Lookup(code[addr])
+	pc := addr + 1
+	for _, kind := range ins.Operands {
+		if pc+kind.Size() > len(code) {
+			break
+		}
+		switch kind {
+		case opcode.Str:
+			size := int(code[pc]) + int(code[pc+1])*256
+			if pc+2+size > len(code) {
+				return fmt.Sprintf("%s with a string of %d bytes", ins.Mnemonic, size)
+			}
+			pc += size
+		case opcode.RegList:
+			pc += int(code[pc])
+		}
+		pc += kind.Size()
+	}
+	return ins.Mnemonic
+}
@@ -0,0 +1,60 @@
+package verify
+
+import (
+	"strings"
+	"testing"
+
+	"gosc-vm/binfmt"
+	"gosc-vm/compiler"
+	"gosc-vm/lexer"
+	"gosc-vm/opcode"
+)
+
+// check verifies the given code, returning the problems as a string.
+func check(code []byte) string {
+	var out []string
+	for _, p := range Program(&binfmt.Program{Code: code}) {
+		out = append(out, p.String())
+	}
+	return strings.Join(out, "\n")
+}
+
+func TestValid(t *testing.T) {
+	src := `
+	store #1, "hello"
+	call sub
+	jmp end
+:sub
+	print_str #1
+	ret
+:data
+	DB 0xFF, 0xFF
+:end
+	exit
+`
+	c := compiler.New(lexer.New(src))
+	c.Compile()
+	if problems := check(c.Output()); problems != "" {
+		t.Fatalf("unexpected problems:\n%s", problems)
+	}
+}
+
+func TestInvalid(t *testing.T) {
+	tests := []struct {
+		code []byte
+		want string
+	}{
+		{[]byte{0xFF}, "0000: unknown opcode FF"},
+		{[]byte{opcode.INT_STORE, 1}, "0000: store runs past the end of the code"},
+		{[]byte{opcode.STRING_STORE, 1, 9, 0, 'h', 'i'}, "0000: store with a string of 9 bytes runs past the end of the code"},
+		{[]byte{opcode.INT_PRINT, 16, opcode.EXIT}, "0000: print_int uses register #16, we have 16"},
+		{[]byte{opcode.JUMP_TO, 1, 0}, "0000: target 0001 lands within the instruction at 0000"},
+		{[]byte{opcode.JUMP_Z, 0, 1, opcode.EXIT}, "0000: target 0100 lies outside the code"},
+		{[]byte{opcode.NOP_OP}, "0001: execution runs past the end of the code"},
+	}
+	for _, tt := range tests {
+		if got := check(tt.code); got != tt.want {
+			t.Errorf("% X: expected %q, got %q", tt.code, tt.want, got)
+		}
+	}
+}